@@ -0,0 +1,219 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	k8sapi "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+const (
+	// cacheHolderLabel is set on cache PVCs to the ID of the job currently
+	// using them.
+	cacheHolderLabel = labelPrefix + "/cache-holder"
+
+	// cacheLockedAtAnnotation is set on cache PVCs to the time at which
+	// they were last locked.
+	cacheLockedAtAnnotation = labelPrefix + "/cache-locked-at"
+)
+
+func cacheClaimName(jctx *JobContext) string {
+	return fmt.Sprintf("cache-project-%s", jctx.ProjectID)
+}
+
+// AcquireCache locks the cache PVC of the project for the current job,
+// creating it with the specified size if it does not exist yet. If another
+// job holds the lock, AcquireCache waits until it gets released, or until
+// that job is gone and the lock is older than staleAfter. The lock of a job
+// whose VM is kept for debugging is held for as long as the VM is kept, so
+// rather than waiting for it, AcquireCache returns the empty string, and the
+// job runs without the cache.
+func AcquireCache(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext, size string, staleAfter time.Duration) (string, error) {
+	name := cacheClaimName(jctx)
+	claims := client.CoreV1().PersistentVolumeClaims(jctx.Namespace)
+
+	waiting := false
+	for {
+		now := time.Now().UTC().Format(time.RFC3339)
+
+		pvc, err := claims.Get(ctx, name, metav1.GetOptions{})
+		switch {
+		case k8serrors.IsNotFound(err):
+			spec, err := cacheClaimSpec(jctx, size)
+			if err != nil {
+				return "", err
+			}
+			pvc = &k8sapi.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: name,
+					Labels: map[string]string{
+						labelPrefix + "/project": jctx.ProjectID,
+						cacheHolderLabel:         jctx.ID,
+					},
+					Annotations: map[string]string{
+						cacheLockedAtAnnotation: now,
+					},
+				},
+				Spec: *spec,
+			}
+			_, err = claims.Create(ctx, pvc, metav1.CreateOptions{})
+			switch {
+			case k8serrors.IsAlreadyExists(err):
+				// Another job created it first; try locking it instead
+				continue
+			case err != nil:
+				return "", err
+			}
+			return name, nil
+		case err != nil:
+			return "", err
+		}
+
+		holder := pvc.Labels[cacheHolderLabel]
+		free := holder == "" || holder == jctx.ID
+		if !free {
+			var retained bool
+			free, retained, err = cacheLockState(ctx, client, jctx, pvc, staleAfter)
+			if err != nil {
+				return "", err
+			}
+			if retained {
+				fmt.Fprintf(os.Stderr, "Cache volume %s is in use by the VM of job %s, which is kept for debugging; running without the cache\n", name, holder)
+				return "", nil
+			}
+		}
+
+		if free {
+			if pvc.Labels == nil {
+				pvc.Labels = map[string]string{}
+			}
+			pvc.Labels[cacheHolderLabel] = jctx.ID
+			if pvc.Annotations == nil {
+				pvc.Annotations = map[string]string{}
+			}
+			pvc.Annotations[cacheLockedAtAnnotation] = now
+
+			// Updates of stale objects are rejected with a conflict, which
+			// guarantees that the lock is only ever taken by one job.
+			_, err := claims.Update(ctx, pvc, metav1.UpdateOptions{})
+			switch {
+			case k8serrors.IsConflict(err):
+				continue
+			case err != nil:
+				return "", err
+			}
+			return name, nil
+		}
+
+		if !waiting {
+			fmt.Fprintf(os.Stderr, "Waiting for cache volume %s, which is in use by another job...\n", name)
+			waiting = true
+		}
+
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// cacheLockState returns whether the lock of the cache PVC is stale, that is
+// whether the job holding it no longer has a VM, and has held the lock for
+// longer than staleAfter, which typically means that its cleanup never ran,
+// and whether the VM of the job holding it is kept for debugging.
+func cacheLockState(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext, pvc *k8sapi.PersistentVolumeClaim, staleAfter time.Duration) (stale, retained bool, err error) {
+	list, err := client.VirtualMachineInstance(jctx.Namespace).List(ctx, &metav1.ListOptions{
+		LabelSelector: fmt.Sprintf(labelPrefix+"/id=%s", pvc.Labels[cacheHolderLabel]),
+	})
+	if err != nil {
+		return false, false, err
+	}
+	for i := range list.Items {
+		if _, ok := RetainedUntil(&list.Items[i]); ok {
+			return false, true, nil
+		}
+	}
+	if len(list.Items) > 0 {
+		return false, false, nil
+	}
+
+	lockedAt, err := time.Parse(time.RFC3339, pvc.Annotations[cacheLockedAtAnnotation])
+	return err != nil || time.Since(lockedAt) >= staleAfter, false, nil
+}
+
+func cacheClaimSpec(jctx *JobContext, size string) (*k8sapi.PersistentVolumeClaimSpec, error) {
+	quantity, err := resource.ParseQuantity(size)
+	if err != nil {
+		return nil, fmt.Errorf("parsing cache size: %w", err)
+	}
+
+	storage, err := jobStorageSpec(jctx)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := k8sapi.PersistentVolumeClaimSpec{
+		AccessModes:      storage.AccessModes,
+		StorageClassName: storage.StorageClassName,
+		VolumeMode:       storage.VolumeMode,
+		Resources: k8sapi.ResourceRequirements{
+			Requests: k8sapi.ResourceList{
+				k8sapi.ResourceStorage: quantity,
+			},
+		},
+	}
+	if len(spec.AccessModes) == 0 {
+		spec.AccessModes = []k8sapi.PersistentVolumeAccessMode{k8sapi.ReadWriteOnce}
+	}
+	return &spec, nil
+}
+
+// ReleaseCache releases the cache PVCs locked by the current job, if any.
+func ReleaseCache(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) error {
+	claims := client.CoreV1().PersistentVolumeClaims(jctx.Namespace)
+
+	list, err := claims.List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf(cacheHolderLabel+"=%s", jctx.ID),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, pvc := range list.Items {
+		pvc := pvc
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			if pvc.Labels[cacheHolderLabel] != jctx.ID {
+				// Another job got the lock, e.g. as a stale one.
+				return nil
+			}
+			delete(pvc.Labels, cacheHolderLabel)
+			delete(pvc.Annotations, cacheLockedAtAnnotation)
+			_, err := claims.Update(ctx, &pvc, metav1.UpdateOptions{})
+			if k8serrors.IsConflict(err) {
+				latest, gerr := claims.Get(ctx, pvc.ObjectMeta.Name, metav1.GetOptions{})
+				if gerr != nil {
+					return gerr
+				}
+				pvc = *latest
+			}
+			return err
+		})
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return fmt.Errorf("releasing cache volume %s: %w", pvc.ObjectMeta.Name, err)
+		}
+	}
+	return nil
+}
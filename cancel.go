@@ -0,0 +1,64 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// CancelledAnnotation holds the time at which the job of a VM got cancelled
+// while running.
+const CancelledAnnotation = labelPrefix + "/cancelled"
+
+// cancelTimeout bounds the requests made on behalf of a cancelled job, whose
+// context can no longer be used.
+const cancelTimeout = 30 * time.Second
+
+// MarkJobVMCancelled annotates the VM of a job that got cancelled mid-run, so
+// that the garbage collector can delete it should cleanup never run.
+func MarkJobVMCancelled(client kubevirt.KubevirtClient, vm *kubevirtapi.VirtualMachineInstance) {
+	ctx, stop := context.WithTimeout(context.Background(), cancelTimeout)
+	defer stop()
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				CancelledAnnotation: time.Now().UTC().Format(time.RFC3339),
+			},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = client.VirtualMachineInstance(vm.ObjectMeta.Namespace).Patch(ctx, vm.ObjectMeta.Name, types.MergePatchType, patch, &metav1.PatchOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		fmt.Fprintf(os.Stderr, "marking Virtual Machine instance %s as cancelled: %v\n", vm.ObjectMeta.Name, err)
+	}
+}
+
+// DeleteCancelledJobVM deletes the VM of a job that got cancelled during
+// prepare, as the job may not get cleaned up, e.g. when the runner itself is
+// shutting down.
+func DeleteCancelledJobVM(client kubevirt.KubevirtClient, vm *kubevirtapi.VirtualMachineInstance) {
+	ctx, stop := context.WithTimeout(context.Background(), cancelTimeout)
+	defer stop()
+
+	fmt.Fprintf(os.Stderr, "Job cancelled, deleting Virtual Machine instance %s\n", vm.ObjectMeta.Name)
+	if err := DeleteJobVM(ctx, client, vm); err != nil && !k8serrors.IsNotFound(err) {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+}
@@ -12,21 +12,62 @@ import (
 	"strings"
 	"time"
 
+	k8sapi "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/watch"
 	kubevirtapi "kubevirt.io/api/core/v1"
 	kubevirt "kubevirt.io/client-go/kubecli"
 )
 
 type CleanupCmd struct {
-	Timeout time.Duration `name:"timeout" default:"1h"`
+	Timeout time.Duration `name:"timeout" help:"Timeout of the cleanup stage; defaults to the job timeout plus --timeout-margin, or 1h"`
 	SkipIf  []string      `name:"skip-if" sep:","`
 }
 
 func (cmd *CleanupCmd) Run(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) error {
+	cmd.Timeout = stageTimeout(cmd.Timeout, jctx)
+
 	vm, err := FindJobVM(ctx, client, jctx)
+	if err == ErrJobVMNotFound {
+		// The VM may have never been created, e.g. because the job got
+		// cancelled first, in which case the cache must still be
+		// released, and the other resources of the job deleted.
+		if err := ReleaseCache(ctx, client, jctx); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		if err := DeleteJobNetworkPolicy(ctx, client, jctx); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		if err := StopServices(ctx, client, jctx); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		if err := DeleteJobRegistrySecret(ctx, client, jctx); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		fmt.Fprintf(os.Stderr, "Virtual Machine instance is already gone\n")
+		return nil
+	}
 	if err != nil {
+		// The VM may still be running: keep it isolated, and holding the
+		// cache, until a later cleanup or gc can tell.
 		return err
 	}
+	tracer.RecordJob(vm.ObjectMeta.CreationTimestamp.Time)
+
+	if until, ok := RetainedUntil(vm); ok && time.Now().Before(until) {
+		fmt.Fprintf(os.Stderr, "Skipping cleanup of Virtual Machine instance %v, which is kept for debugging until %v\n", vm.ObjectMeta.Name, until.Format(time.RFC3339))
+		RecordJobEvent(ctx, client, vm, k8sapi.EventTypeNormal, EventCleanupSkipped, "Kept for debugging job %s until %v", jctx.JobID, until.Format(time.RFC3339))
+
+		// Services aren't needed to debug the VM, and the registry
+		// credentials of the job expire anyway.
+		if err := StopServices(ctx, client, jctx); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		if err := DeleteJobRegistrySecret(ctx, client, jctx); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		return nil
+	}
 
 	for _, skipIf := range cmd.SkipIf {
 		check := func() bool { return string(vm.Status.Phase) == skipIf }
@@ -35,22 +76,42 @@ func (cmd *CleanupCmd) Run(ctx context.Context, client kubevirt.KubevirtClient,
 		}
 		if check() {
 			fmt.Fprintf(os.Stderr, "Skipping cleanup of Virtual Machine instance %v because of --skip-if=%v\n", vm.ObjectMeta.Name, skipIf)
+			RecordJobEvent(ctx, client, vm, k8sapi.EventTypeNormal, EventCleanupSkipped, "Cleanup of job %s skipped because of --skip-if=%v", jctx.JobID, skipIf)
 			return nil
 		}
 	}
 
-	fmt.Fprintf(os.Stderr, "Deleting Virtual Machine instance %v\n", vm.ObjectMeta.Name)
+	// Hotplugged volumes would get detached along with the VM anyway, but
+	// doing it first releases them as early as possible.
+	if err := UnplugVolumes(ctx, client, vm); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
 
-	if err := client.VirtualMachineInstance(jctx.Namespace).Delete(ctx, vm.ObjectMeta.Name, nil); err != nil {
+	// Services would get garbage-collected along with the VM, but deleting
+	// them first keeps others from reaching a VM that is going away.
+	if err := DeleteJobService(ctx, client, vm); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+	if err := DeleteExposedService(ctx, client, jctx); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+
+	section := StartSection("cleanup_vm", fmt.Sprintf("Deleting Virtual Machine instance %v", vm.ObjectMeta.Name))
+	defer section.End()
+
+	// The VM may already be gone, e.g. when the job got cancelled; the
+	// watch below then returns as soon as it lists no VM.
+	if err := DeleteJobVM(ctx, client, vm); err != nil && !k8serrors.IsNotFound(err) {
 		return err
 	}
+	RecordJobEvent(ctx, client, vm, k8sapi.EventTypeNormal, EventDeleted, "Deleted by the cleanup of job %s", jctx.JobID)
 
 	timeout, stop := context.WithTimeout(ctx, cmd.Timeout)
 	defer stop()
 
 	// Wait for VM to go away
 
-	return WatchJobVM(timeout, client, jctx, vm, func(et watch.EventType, _ *kubevirtapi.VirtualMachineInstance) error {
+	err = WatchJobVM(timeout, client, jctx, vm, func(et watch.EventType, _ *kubevirtapi.VirtualMachineInstance) error {
 		switch et {
 		case watch.Error:
 			// We can't just retry like we do in prepare, because the deleted
@@ -63,4 +124,25 @@ func (cmd *CleanupCmd) Run(ctx context.Context, client kubevirt.KubevirtClient,
 		}
 		return nil
 	})
+
+	if err != nil {
+		return err
+	}
+	section.End()
+	metrics.RecordActiveVMs(ctx, client, jctx.Namespace)
+
+	if err := StopServices(ctx, client, jctx); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+	if err := DeleteJobRegistrySecret(ctx, client, jctx); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+
+	// The VM stays isolated until it's gone
+	if err := DeleteJobNetworkPolicy(ctx, client, jctx); err != nil {
+		return err
+	}
+
+	// The cache can only be used by other jobs once the VM is gone
+	return ReleaseCache(ctx, client, jctx)
 }
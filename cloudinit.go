@@ -0,0 +1,92 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+const cloudConfigHeader = "#cloud-config"
+
+// editCloudConfig decodes the specified cloud-config user-data, applies the
+// edit function to it, and re-encodes it. If userData is empty, the edit
+// is applied to a new cloud-config. The purpose describes the edit, and is
+// used in error messages.
+func editCloudConfig(userData, purpose string, edit func(config map[string]interface{})) (string, error) {
+	if userData != "" && !strings.HasPrefix(userData, cloudConfigHeader) {
+		return "", fmt.Errorf("cannot %s in cloud-init user-data: user-data must be a %s document", purpose, cloudConfigHeader)
+	}
+
+	config := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(userData), &config); err != nil {
+		return "", fmt.Errorf("parsing cloud-init user-data: %w", err)
+	}
+
+	edit(config)
+
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	return cloudConfigHeader + "\n" + string(out), nil
+}
+
+// AddVirtiofsMount mounts the virtiofs filesystem with the specified tag on
+// mountPoint via the specified cloud-config user-data.
+func AddVirtiofsMount(userData, tag, mountPoint string) (string, error) {
+	return editCloudConfig(userData, "mount "+tag+" filesystem", func(config map[string]interface{}) {
+		// The mounts module only knows about block and network devices, so
+		// the filesystem gets mounted on every boot instead.
+		bootcmd, _ := config["bootcmd"].([]interface{})
+		config["bootcmd"] = append(bootcmd,
+			[]interface{}{"mkdir", "-p", mountPoint},
+			[]interface{}{"mount", "-t", "virtiofs", tag, mountPoint},
+		)
+	})
+}
+
+// AddDiskMount formats the specified device with the specified filesystem
+// label, unless it already has a filesystem, and mounts it on mountPoint via
+// the specified cloud-config user-data.
+func AddDiskMount(userData, device, mountPoint, label string) (string, error) {
+	return editCloudConfig(userData, "mount "+label+" disk", func(config map[string]interface{}) {
+		fsSetup, _ := config["fs_setup"].([]interface{})
+		config["fs_setup"] = append(fsSetup, map[string]interface{}{
+			"device":     device,
+			"partition":  "none",
+			"filesystem": "ext4",
+			"label":      label,
+		})
+
+		mounts, _ := config["mounts"].([]interface{})
+		config["mounts"] = append(mounts, []interface{}{device, mountPoint, "ext4", "defaults,nofail", "0", "2"})
+	})
+}
+
+// AddHostsEntries adds the specified entries, mapping IPs to hostnames, to
+// /etc/hosts via the specified cloud-config user-data.
+func AddHostsEntries(userData string, hosts map[string][]string) (string, error) {
+	return editCloudConfig(userData, "add hosts entries", func(config map[string]interface{}) {
+		ips := make([]string, 0, len(hosts))
+		for ip := range hosts {
+			ips = append(ips, ip)
+		}
+		sort.Strings(ips)
+
+		// /etc/hosts may get regenerated, so the entries are added on every
+		// boot, unless they are already there.
+		bootcmd, _ := config["bootcmd"].([]interface{})
+		for _, ip := range ips {
+			entry := quote(ip + " " + strings.Join(hosts[ip], " "))
+			bootcmd = append(bootcmd, fmt.Sprintf("grep -qxF %s /etc/hosts || echo %s >> /etc/hosts", entry, entry))
+		}
+		config["bootcmd"] = bootcmd
+	})
+}
@@ -0,0 +1,135 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+func TestEditCloudConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		userData string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name: "empty",
+			want: "#cloud-config\nruncmd:\n- \"true\"\n",
+		},
+		{
+			name:     "existing keys",
+			userData: "#cloud-config\nhostname: job\nruncmd:\n- echo hello\n",
+			want:     "#cloud-config\nhostname: job\nruncmd:\n- echo hello\n- \"true\"\n",
+		},
+		{
+			name:     "not a cloud-config",
+			userData: "#!/bin/sh\necho hello\n",
+			wantErr:  true,
+		},
+		{
+			name:     "invalid YAML",
+			userData: "#cloud-config\nruncmd: [\n",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := editCloudConfig(tt.userData, "test", func(config map[string]interface{}) {
+				runcmd, _ := config["runcmd"].([]interface{})
+				config["runcmd"] = append(runcmd, "true")
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("editCloudConfig(%q) error = %v, want error: %v", tt.userData, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("editCloudConfig(%q) = %q, want %q", tt.userData, got, tt.want)
+			}
+		})
+	}
+}
+
+// The hosts entries are checked by running the boot commands with a shell,
+// so that the test holds regardless of how exactly entries get quoted.
+func TestAddHostsEntries(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no shell to run the boot commands with")
+	}
+
+	tests := []struct {
+		name  string
+		hosts map[string][]string
+		want  []string
+	}{
+		{
+			name:  "aliases",
+			hosts: map[string][]string{"10.0.0.7": {"postgres", "db"}},
+			want:  []string{"10.0.0.7 postgres db"},
+		},
+		{
+			name: "sorted by IP",
+			hosts: map[string][]string{
+				"10.0.0.9": {"redis"},
+				"10.0.0.7": {"postgres"},
+			},
+			want: []string{"10.0.0.7 postgres", "10.0.0.9 redis"},
+		},
+		{
+			name:  "shell metacharacters",
+			hosts: map[string][]string{"10.0.0.7": {"$(touch injected)", "`touch injected`", "it's;touch injected"}},
+			want:  []string{"10.0.0.7 $(touch injected) `touch injected` it's;touch injected"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userData, err := AddHostsEntries("", tt.hosts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var config struct {
+				Bootcmd []string `json:"bootcmd"`
+			}
+			if err := yaml.Unmarshal([]byte(userData), &config); err != nil {
+				t.Fatal(err)
+			}
+
+			dir := t.TempDir()
+			hostsPath := filepath.Join(dir, "hosts")
+			if err := os.WriteFile(hostsPath, []byte("127.0.0.1 localhost\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			// Entries already there must not get added again on reboot.
+			for boot := 0; boot < 2; boot++ {
+				for _, cmd := range config.Bootcmd {
+					sh := exec.Command("sh", "-c", strings.Replace(cmd, "/etc/hosts", hostsPath, -1))
+					sh.Dir = dir
+					if out, err := sh.CombinedOutput(); err != nil {
+						t.Fatalf("running %q: %v\n%s", cmd, err, out)
+					}
+				}
+			}
+
+			data, err := os.ReadFile(hostsPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := strings.Join(append([]string{"127.0.0.1 localhost"}, tt.want...), "\n") + "\n"
+			if string(data) != want {
+				t.Errorf("hosts file is %q, want %q", data, want)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "injected")); err == nil {
+				t.Errorf("boot commands %q ran part of a hostname", config.Bootcmd)
+			}
+		})
+	}
+}
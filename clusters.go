@@ -0,0 +1,124 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClusterConfig is the set of clusters that the config stage dispatches job
+// VMs to, named by kubeconfig context.
+type ClusterConfig struct {
+	Clusters      []string `name:"cluster" sep:"," help:"Kubeconfig contexts of the clusters to dispatch job VMs to; the chosen one is passed to the following stages"`
+	ClusterPolicy string   `name:"cluster-policy" default:"round-robin" enum:"round-robin,least-loaded,tag" help:"How to choose the cluster of a job VM (round-robin, least-loaded, tag)"`
+	ClusterTags   []string `name:"cluster-tag" sep:"," help:"Clusters that jobs can select with KUBEVIRT_CLUSTER, as tag=context; a tag may map to several clusters"`
+	ClusterState  string   `name:"cluster-state" type:"path" help:"File keeping track of the last cluster chosen by the round-robin policy"`
+}
+
+// SelectCluster returns the context of the cluster to run the job VM on, or
+// the empty string if no clusters are configured.
+func (cfg *ClusterConfig) SelectCluster(ctx context.Context, jctx *JobContext) (string, error) {
+	if len(cfg.Clusters) == 0 {
+		return "", nil
+	}
+
+	candidates := cfg.Clusters
+	if jctx.Cluster != "" {
+		var err error
+		candidates, err = cfg.taggedClusters(jctx.Cluster)
+		if err != nil {
+			return "", err
+		}
+	} else if cfg.ClusterPolicy == "tag" {
+		return "", fmt.Errorf("the cluster policy is tag, but the job does not set KUBEVIRT_CLUSTER")
+	}
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+
+	switch cfg.ClusterPolicy {
+	case "least-loaded":
+		return leastLoadedCluster(ctx, candidates, jctx.Namespace)
+	default:
+		return cfg.nextCluster(candidates)
+	}
+}
+
+// taggedClusters returns the clusters mapped to the specified tag.
+func (cfg *ClusterConfig) taggedClusters(tag string) ([]string, error) {
+	var clusters []string
+	for _, mapping := range cfg.ClusterTags {
+		kv := strings.SplitN(mapping, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("--cluster-tag %q must be of the form tag=context", mapping)
+		}
+		if kv[0] == tag {
+			clusters = append(clusters, kv[1])
+		}
+	}
+	if len(clusters) == 0 {
+		return nil, fmt.Errorf("no cluster is tagged %q", tag)
+	}
+	return clusters, nil
+}
+
+// nextCluster returns the cluster following the one chosen last. This is
+// best-effort: jobs configured at the same time may get the same cluster.
+func (cfg *ClusterConfig) nextCluster(clusters []string) (string, error) {
+	path := cfg.ClusterState
+	if path == "" {
+		path = filepath.Join(os.TempDir(), "gitlab-runner-kubevirt-cluster")
+	}
+
+	next := 0
+	if data, err := os.ReadFile(path); err == nil {
+		if last, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			next = last + 1
+		}
+	} else if !os.IsNotExist(err) {
+		return "", fmt.Errorf("reading cluster state: %w", err)
+	}
+
+	if err := os.WriteFile(path, []byte(strconv.Itoa(next)+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("writing cluster state: %w", err)
+	}
+	return clusters[next%len(clusters)], nil
+}
+
+// leastLoadedCluster returns the cluster running the fewest job VMs in the
+// namespace. Clusters that cannot be reached are skipped.
+func leastLoadedCluster(ctx context.Context, clusters []string, namespace string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	best, bestCount := "", -1
+	for _, cluster := range clusters {
+		client, err := KubeClientForContext(cluster)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "skipping cluster %s: %v\n", cluster, err)
+			continue
+		}
+		count, err := countJobVMs(ctx, client, namespace)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "skipping cluster %s: %v\n", cluster, err)
+			continue
+		}
+		fmt.Fprintf(Debug, "cluster %s runs %d job VMs\n", cluster, count)
+		if bestCount == -1 || count < bestCount {
+			best, bestCount = cluster, count
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("none of the clusters %s could be reached", strings.Join(clusters, ", "))
+	}
+	return best, nil
+}
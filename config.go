@@ -6,24 +6,62 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"runtime/debug"
 )
 
-type ConfigCmd struct{}
+type ConfigCmd struct {
+	BuildsDir         string            `name:"builds-dir" help:"Path of the builds directory in job VMs"`
+	BuildsDirIsShared bool              `name:"builds-dir-is-shared" help:"Whether the builds directory is shared between concurrent jobs"`
+	CacheDir          string            `name:"cache-dir" help:"Path of the cache directory in job VMs, when the per-project cache volume is enabled"`
+	JobEnv            map[string]string `name:"job-env" mapsep:"," help:"Additional environment variables of the driver in the following stages"`
+
+	ClusterConfig `embed:""`
+}
 
 var version string
 
-func (ConfigCmd) Run() error {
+// shortVersion returns the version of the driver, without the details of
+// its build.
+func shortVersion() string {
+	if version != "" {
+		return version
+	}
+	if binfo, ok := debug.ReadBuildInfo(); ok {
+		return binfo.Main.Version
+	}
+	return "unknown"
+}
+
+func (cmd ConfigCmd) Run(ctx context.Context, jctx *JobContext) error {
 	var config struct {
-		Driver struct {
+		BuildsDir         string            `json:"builds_dir,omitempty"`
+		BuildsDirIsShared bool              `json:"builds_dir_is_shared,omitempty"`
+		CacheDir          string            `json:"cache_dir,omitempty"`
+		JobEnv            map[string]string `json:"job_env,omitempty"`
+		Driver            struct {
 			Name    string `json:"name"`
 			Version string `json:"version"`
 		} `json:"driver"`
 	}
 
+	config.BuildsDir = cmd.BuildsDir
+	config.BuildsDirIsShared = cmd.BuildsDirIsShared
+	config.CacheDir = cmd.CacheDir
+	config.JobEnv = mergeMaps(cmd.JobEnv, map[string]string{
+		"KUBEVIRT_VM_NAME": JobVMName(jctx),
+	})
+
+	cluster, err := cmd.SelectCluster(ctx, jctx)
+	if err != nil {
+		return fmt.Errorf("selecting cluster: %w", err)
+	}
+	if cluster != "" {
+		config.JobEnv["KUBEVIRT_KUBE_CONTEXT"] = cluster
+	}
 	config.Driver.Name = "gitlab-runner-kubevirt"
 	if binfo, ok := debug.ReadBuildInfo(); ok {
 		var k8sdep *debug.Module
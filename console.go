@@ -0,0 +1,130 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// RunConsole executes the script over the serial console of the VM, and
+// returns its exit status.
+//
+// The console is expected to present an interactive, logged-in bash
+// session. The script is sent base64-encoded through a heredoc, then
+// executed between two markers, the latter of which carries the exit status
+// of the script. Everything printed between these markers is forwarded to
+// stdout.
+func RunConsole(
+	ctx context.Context,
+	client kubevirt.KubevirtClient,
+	vm *kubevirtapi.VirtualMachineInstance,
+	shell, script, scriptPath string,
+	connTimeout time.Duration,
+) (int, error) {
+
+	if shell != "bash" {
+		return 0, fmt.Errorf("the console method does not support the %s shell", shell)
+	}
+
+	contents, err := os.ReadFile(script)
+	if err != nil {
+		return 0, err
+	}
+
+	var nonceBytes [8]byte
+	if _, err := rand.Read(nonceBytes[:]); err != nil {
+		return 0, err
+	}
+	nonce := hex.EncodeToString(nonceBytes[:])
+
+	// The markers get split in two in the commands we type, so that the
+	// terminal echoing them back can't be mistaken for the real thing.
+	const beginPrefix, endPrefix = "__KUBEVIRT_BEGIN_", "__KUBEVIRT_END_"
+	beginMarker := beginPrefix + nonce
+	endMarker := endPrefix + nonce
+	eofMarker := "__KUBEVIRT_EOF_" + nonce
+
+	var input strings.Builder
+	input.WriteString("\nstty -echo\n")
+	fmt.Fprintf(&input, "base64 -d > %s <<'%s'\n", scriptPath, eofMarker)
+	encoded := base64.StdEncoding.EncodeToString(contents)
+	for len(encoded) > 76 {
+		input.WriteString(encoded[:76] + "\n")
+		encoded = encoded[76:]
+	}
+	input.WriteString(encoded + "\n")
+	input.WriteString(eofMarker + "\n")
+	fmt.Fprintf(&input, "printf '%%s%%s\\n' %s %s; bash %s; printf '%%s%%s %%d\\n' %s %s $?; stty echo\n",
+		beginPrefix, nonce, scriptPath, endPrefix, nonce)
+
+	fmt.Fprintf(Debug, "connecting to serial console of %v\n", vm.ObjectMeta.Name)
+
+	stream, err := client.VirtualMachineInstance(vm.ObjectMeta.Namespace).SerialConsole(vm.ObjectMeta.Name, &kubevirt.SerialConsoleOptions{
+		ConnectionTimeout: connTimeout,
+	})
+	if err != nil {
+		return 0, err
+	}
+	conn := stream.AsConn()
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if _, err := io.WriteString(conn, input.String()); err != nil {
+		return 0, err
+	}
+
+	started := false
+	rd := bufio.NewReader(conn)
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			return 0, fmt.Errorf("reading serial console: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if !started {
+			fmt.Fprintln(Debug, line)
+			started = strings.Contains(line, beginMarker)
+			continue
+		}
+
+		if idx := strings.Index(line, endMarker); idx != -1 {
+			if idx > 0 {
+				fmt.Fprintln(os.Stdout, line[:idx])
+			}
+			var status int
+			if _, err := fmt.Sscanf(line[idx+len(endMarker):], " %d", &status); err != nil {
+				return 0, fmt.Errorf("parsing exit status from serial console: %w", err)
+			}
+			return status, nil
+		}
+		fmt.Fprintln(os.Stdout, line)
+	}
+}
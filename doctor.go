@@ -0,0 +1,204 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	authv1 "k8s.io/api/authorization/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// DoctorCmd checks that the environment of the runner lets the driver run
+// jobs, and prints a report of what does not.
+type DoctorCmd struct {
+	CheckImages []string      `name:"check-image" help:"Image whose registry must be reachable, e.g. the default image of job VMs; can be repeated"`
+	Timeout     time.Duration `name:"timeout" default:"1m" help:"Timeout of the checks"`
+}
+
+// permission is an RBAC permission of the driver in the namespace of job VMs.
+type permission struct {
+	group, resource, subresource, verb string
+
+	// feature is the feature requiring the permission, or empty if the
+	// driver can't do without it.
+	feature string
+}
+
+var permissions = []permission{
+	{kubevirtapi.GroupVersion.Group, "virtualmachineinstances", "", "create", ""},
+	{kubevirtapi.GroupVersion.Group, "virtualmachineinstances", "", "get", ""},
+	{kubevirtapi.GroupVersion.Group, "virtualmachineinstances", "", "list", ""},
+	{kubevirtapi.GroupVersion.Group, "virtualmachineinstances", "", "watch", ""},
+	{kubevirtapi.GroupVersion.Group, "virtualmachineinstances", "", "delete", ""},
+	{kubevirtapi.GroupVersion.Group, "virtualmachineinstances", "", "patch", "--keep-on-failure, cancellation"},
+	{kubevirtapi.GroupVersion.Group, "virtualmachineinstances", "", "update", "hotplugged volumes"},
+	{kubevirtapi.GroupVersion.Group, "virtualmachines", "", "create", "instancetypes, root disk cloning"},
+	{kubevirtapi.GroupVersion.Group, "virtualmachines", "", "list", "gc"},
+	{kubevirtapi.GroupVersion.Group, "virtualmachines", "", "delete", "instancetypes, root disk cloning"},
+	{"subresources.kubevirt.io", "virtualmachineinstances", "portforward", "get", "--ssh-tunnel"},
+	{"subresources.kubevirt.io", "virtualmachineinstances", "console", "get", "--method console"},
+	{"subresources.kubevirt.io", "virtualmachineinstances", "addvolume", "update", "hotplugged volumes"},
+	{"subresources.kubevirt.io", "virtualmachineinstances", "removevolume", "update", "hotplugged volumes"},
+	{"", "secrets", "", "create", "--ssh-ephemeral-key, --job-registry-credentials"},
+	{"", "secrets", "", "get", "--ssh-ephemeral-key"},
+	{"", "secrets", "", "list", "gc"},
+	{"", "secrets", "", "delete", "--ssh-ephemeral-key, --job-registry-credentials"},
+	{"", "persistentvolumeclaims", "", "create", "per-project cache"},
+	{"", "persistentvolumeclaims", "", "get", "per-project cache"},
+	{"", "persistentvolumeclaims", "", "list", "per-project cache"},
+	{"", "persistentvolumeclaims", "", "update", "per-project cache"},
+	{"", "persistentvolumeclaims", "", "delete", "per-project cache"},
+	{"", "pods", "", "create", "--services"},
+	{"", "pods", "", "get", "--services"},
+	{"", "pods", "", "list", "--services"},
+	{"", "pods", "", "patch", "--services"},
+	{"", "pods", "", "delete", "--services"},
+	{"", "pods", "", "deletecollection", "--services"},
+	{"", "services", "", "create", "--ssh-service, exposed ports"},
+	{"", "services", "", "get", "exposed ports"},
+	{"", "services", "", "list", "--ssh-service, exposed ports"},
+	{"", "services", "", "delete", "--ssh-service, exposed ports"},
+	{"networking.k8s.io", "networkpolicies", "", "create", "--network-policy"},
+	{"networking.k8s.io", "networkpolicies", "", "list", "gc"},
+	{"networking.k8s.io", "networkpolicies", "", "delete", "--network-policy"},
+	{"cdi.kubevirt.io", "datavolumes", "", "get", "root disk cloning"},
+	{"cdi.kubevirt.io", "datavolumes", "", "list", "gc"},
+	{"cdi.kubevirt.io", "datavolumes", "", "deletecollection", "gc"},
+	{"", "events", "", "create", "--events"},
+}
+
+func (cmd *DoctorCmd) Run(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) error {
+	ctx, stop := context.WithTimeout(ctx, cmd.Timeout)
+	defer stop()
+
+	failed := 0
+	report := func(status, format string, args ...interface{}) {
+		if status == "FAIL" {
+			failed++
+		}
+		fmt.Fprintf(os.Stdout, "[%s] %s\n", status, fmt.Sprintf(format, args...))
+	}
+
+	info, err := client.DiscoveryClient().ServerVersion()
+	if err != nil {
+		report("FAIL", "Kubernetes API server: %v", err)
+		return fmt.Errorf("cannot reach the Kubernetes API server")
+	}
+	report("PASS", "Kubernetes API server: version %s", info.GitVersion)
+
+	if info, err := client.ServerVersion().Get(); err != nil {
+		report("FAIL", "KubeVirt: %v", err)
+	} else {
+		report("PASS", "KubeVirt: version %s", info.GitVersion)
+	}
+
+	if _, err := client.DiscoveryClient().ServerResourcesForGroupVersion("cdi.kubevirt.io/v1beta1"); err != nil {
+		report("WARN", "CDI: %v; importing, cloning and restoring disks is unavailable", err)
+	} else {
+		report("PASS", "CDI: installed")
+	}
+
+	_, err = client.CoreV1().Namespaces().Get(ctx, jctx.Namespace, metav1.GetOptions{})
+	switch {
+	case k8serrors.IsForbidden(err):
+		// Runners commonly aren't allowed to get namespaces; listing VMs
+		// tells whether the namespace exists just as well.
+		if _, err := client.VirtualMachineInstance(jctx.Namespace).List(ctx, &metav1.ListOptions{Limit: 1}); err != nil {
+			report("FAIL", "Namespace %s: %v", jctx.Namespace, err)
+		} else {
+			report("PASS", "Namespace %s: accessible", jctx.Namespace)
+		}
+	case err != nil:
+		report("FAIL", "Namespace %s: %v", jctx.Namespace, err)
+	default:
+		report("PASS", "Namespace %s: exists", jctx.Namespace)
+	}
+
+	for _, perm := range permissions {
+		resource := perm.resource
+		if perm.subresource != "" {
+			resource += "/" + perm.subresource
+		}
+		if perm.group != "" {
+			resource += "." + perm.group
+		}
+
+		review, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authv1.SelfSubjectAccessReview{
+			Spec: authv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authv1.ResourceAttributes{
+					Namespace:   jctx.Namespace,
+					Verb:        perm.verb,
+					Group:       perm.group,
+					Resource:    perm.resource,
+					Subresource: perm.subresource,
+				},
+			},
+		}, metav1.CreateOptions{})
+		switch {
+		case err != nil:
+			report("FAIL", "Permission to %s %s: %v", perm.verb, resource, err)
+		case review.Status.Allowed:
+			report("PASS", "Permission to %s %s", perm.verb, resource)
+		case perm.feature != "":
+			report("WARN", "Permission to %s %s: denied; required by %s", perm.verb, resource, perm.feature)
+		default:
+			report("FAIL", "Permission to %s %s: denied", perm.verb, resource)
+		}
+	}
+
+	for _, image := range cmd.CheckImages {
+		if err := checkRegistry(ctx, image); err != nil {
+			report("FAIL", "Registry of image %s: %v", image, err)
+		} else {
+			report("PASS", "Registry of image %s: reachable", image)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
+// checkRegistry checks that the registry hosting the specified image answers
+// requests to its API, from the runner. Nodes pull images on their own, and
+// may not have the same access to the registry.
+func checkRegistry(ctx context.Context, image string) error {
+	host := "registry-1.docker.io"
+	if i := strings.Index(image, "/"); i != -1 {
+		first := image[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			host = first
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+host+"/v2/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	// Registries requiring authentication answer 401, which still shows
+	// that they are reachable.
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusUnauthorized:
+		return nil
+	}
+	return fmt.Errorf("%s answered %s", host, resp.Status)
+}
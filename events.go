@@ -0,0 +1,66 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	k8sapi "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// Reasons of the events posted on job VMs.
+const (
+	EventCreated         = "Created"
+	EventReady           = "Ready"
+	EventJobStageStarted = "JobStageStarted"
+	EventJobFailed       = "JobFailed"
+	EventDeleted         = "Deleted"
+	EventCleanupSkipped  = "CleanupSkipped"
+)
+
+// RecordJobEvent posts an event on the job VM, so that the activity of jobs
+// shows up in `kubectl describe`. Events are best-effort: failing to post
+// one does not fail the stage.
+func RecordJobEvent(ctx context.Context, client kubevirt.KubevirtClient, vm *kubevirtapi.VirtualMachineInstance, eventType, reason, format string, args ...interface{}) {
+	if !cli.Events || vm == nil {
+		return
+	}
+
+	now := metav1.Now()
+	event := k8sapi.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: vm.ObjectMeta.Name + ".",
+			Namespace:    vm.ObjectMeta.Namespace,
+			Labels: map[string]string{
+				labelPrefix + "/id": vm.ObjectMeta.Labels[labelPrefix+"/id"],
+			},
+		},
+		InvolvedObject: k8sapi.ObjectReference{
+			Kind:            "VirtualMachineInstance",
+			APIVersion:      kubevirtapi.GroupVersion.String(),
+			Name:            vm.ObjectMeta.Name,
+			Namespace:       vm.ObjectMeta.Namespace,
+			UID:             vm.ObjectMeta.UID,
+			ResourceVersion: vm.ObjectMeta.ResourceVersion,
+		},
+		Reason:         reason,
+		Message:        fmt.Sprintf(format, args...),
+		Type:           eventType,
+		Source:         k8sapi.EventSource{Component: "gitlab-runner-kubevirt"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	_, err := client.CoreV1().Events(vm.ObjectMeta.Namespace).Create(ctx, &event, metav1.CreateOptions{})
+	if err != nil {
+		fmt.Fprintf(Debug, "posting %s event on Virtual Machine instance %s: %v\n", reason, vm.ObjectMeta.Name, err)
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+)
+
+// GcCmd deletes the VMs and other resources left over by jobs whose cleanup
+// never ran, e.g. because the runner crashed.
+type GcCmd struct {
+	TTL      time.Duration `name:"ttl" default:"24h" help:"Age past which VMs without a job deadline, and resources of jobs without a VM, are deleted"`
+	Interval time.Duration `name:"interval" help:"Collect garbage repeatedly at this interval, rather than once"`
+	DryRun   bool          `name:"dry-run" help:"Only print what would be deleted"`
+}
+
+func (cmd *GcCmd) Run(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) error {
+	for {
+		err := cmd.collect(ctx, client, jctx.Namespace)
+		if cmd.Interval == 0 {
+			return err
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+
+		select {
+		case <-time.After(cmd.Interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// expired returns why the specified VM, or VirtualMachine, outlived its job,
+// if it did. VMs kept
+// for debugging are expired once their retention period is over, VMs of
+// cancelled jobs right away, and other VMs once the deadline of their job is
+// past, or, when the deadline of the job is unknown, once they are older than
+// the TTL.
+func (cmd *GcCmd) expired(meta *metav1.ObjectMeta, now time.Time) (string, bool) {
+	if until, ok := retainedUntil(meta); ok {
+		return fmt.Sprintf("kept for debugging until %v", until.Format(time.RFC3339)), now.After(until)
+	}
+	if cancelled, err := time.Parse(time.RFC3339, meta.Annotations[CancelledAnnotation]); err == nil {
+		return fmt.Sprintf("its job got cancelled at %v", cancelled.Format(time.RFC3339)), true
+	}
+	if deadline, err := time.Parse(time.RFC3339, meta.Annotations[DeadlineAnnotation]); err == nil {
+		return fmt.Sprintf("its job timed out at %v", deadline.Format(time.RFC3339)), now.After(deadline)
+	}
+	created := meta.CreationTimestamp.Time
+	return fmt.Sprintf("created at %v, more than %v ago", created.Format(time.RFC3339), cmd.TTL), now.Sub(created) > cmd.TTL
+}
+
+func (cmd *GcCmd) collect(ctx context.Context, client kubevirt.KubevirtClient, namespace string) error {
+	now := time.Now()
+
+	vms, err := client.VirtualMachineInstance(namespace).List(ctx, &metav1.ListOptions{
+		LabelSelector: labelPrefix + "/id",
+	})
+	if err != nil {
+		return err
+	}
+
+	// The resources of jobs that still have a VM are left alone, even if
+	// the VM is getting deleted; they are collected once it is gone.
+	live := map[string]bool{}
+	for i := range vms.Items {
+		vm := &vms.Items[i]
+		live[vm.ObjectMeta.Labels[labelPrefix+"/id"]] = true
+
+		reason, expired := cmd.expired(&vm.ObjectMeta, now)
+		if !expired || vm.ObjectMeta.DeletionTimestamp != nil {
+			continue
+		}
+
+		fmt.Fprintf(os.Stderr, "Deleting Virtual Machine instance %s: %s\n", vm.ObjectMeta.Name, reason)
+		if cmd.DryRun {
+			continue
+		}
+		if err := DeleteJobVM(ctx, client, vm); err != nil && !k8serrors.IsNotFound(err) {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}
+
+	// VirtualMachines whose instance never got created, e.g. because the
+	// import of their root disk failed, or prepare got killed in between,
+	// are collected like instances.
+	owners, err := client.VirtualMachine(namespace).List(&metav1.ListOptions{
+		LabelSelector: labelPrefix + "/id",
+	})
+	if err != nil {
+		return err
+	}
+	for i := range owners.Items {
+		owner := &owners.Items[i]
+		id := owner.ObjectMeta.Labels[labelPrefix+"/id"]
+		if live[id] {
+			continue
+		}
+		live[id] = true
+
+		reason, expired := cmd.expired(&owner.ObjectMeta, now)
+		if !expired || owner.ObjectMeta.DeletionTimestamp != nil {
+			continue
+		}
+
+		fmt.Fprintf(os.Stderr, "Deleting Virtual Machine %s, which has no instance: %s\n", owner.ObjectMeta.Name, reason)
+		if cmd.DryRun {
+			continue
+		}
+		if err := client.VirtualMachine(namespace).Delete(owner.ObjectMeta.Name, &metav1.DeleteOptions{}); err != nil && !k8serrors.IsNotFound(err) {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}
+
+	orphans := map[string]bool{}
+	visit := func(id string, since time.Time) {
+		if id != "" && !live[id] && now.Sub(since) > cmd.TTL {
+			orphans[id] = true
+		}
+	}
+
+	byID := metav1.ListOptions{LabelSelector: labelPrefix + "/id"}
+
+	policies, err := client.NetworkingV1().NetworkPolicies(namespace).List(ctx, byID)
+	if err != nil {
+		return err
+	}
+	for _, policy := range policies.Items {
+		visit(policy.ObjectMeta.Labels[labelPrefix+"/id"], policy.ObjectMeta.CreationTimestamp.Time)
+	}
+
+	secrets, err := client.CoreV1().Secrets(namespace).List(ctx, byID)
+	if err != nil {
+		return err
+	}
+	for _, secret := range secrets.Items {
+		visit(secret.ObjectMeta.Labels[labelPrefix+"/id"], secret.ObjectMeta.CreationTimestamp.Time)
+	}
+
+	pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: serviceOfLabel})
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods.Items {
+		visit(pod.ObjectMeta.Labels[serviceOfLabel], pod.ObjectMeta.CreationTimestamp.Time)
+	}
+
+	dataVolumes := client.CdiClient().CdiV1beta1().DataVolumes(namespace)
+	dvs, err := dataVolumes.List(ctx, byID)
+	switch {
+	case k8serrors.IsNotFound(err):
+		// CDI is not installed.
+		dvs = &cdiv1.DataVolumeList{}
+	case err != nil:
+		return err
+	}
+	for _, dv := range dvs.Items {
+		visit(dv.ObjectMeta.Labels[labelPrefix+"/id"], dv.ObjectMeta.CreationTimestamp.Time)
+	}
+
+	claims, err := client.CoreV1().PersistentVolumeClaims(namespace).List(ctx, metav1.ListOptions{LabelSelector: cacheHolderLabel})
+	if err != nil {
+		return err
+	}
+	for _, pvc := range claims.Items {
+		lockedAt, err := time.Parse(time.RFC3339, pvc.ObjectMeta.Annotations[cacheLockedAtAnnotation])
+		if err != nil {
+			lockedAt = pvc.ObjectMeta.CreationTimestamp.Time
+		}
+		visit(pvc.ObjectMeta.Labels[cacheHolderLabel], lockedAt)
+	}
+
+	ids := make([]string, 0, len(orphans))
+	for id := range orphans {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		fmt.Fprintf(os.Stderr, "Deleting resources left over by job %s\n", id)
+		if cmd.DryRun {
+			continue
+		}
+
+		jctx := &JobContext{ID: id, Namespace: namespace}
+		if err := DeleteJobNetworkPolicy(ctx, client, jctx); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		if err := StopServices(ctx, client, jctx); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		if err := DeleteJobRegistrySecret(ctx, client, jctx); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		if err := ReleaseCache(ctx, client, jctx); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		if err := dataVolumes.DeleteCollection(ctx, metav1.DeleteOptions{}, *Selector(jctx)); err != nil && !k8serrors.IsNotFound(err) {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}
+	return nil
+}
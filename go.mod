@@ -14,6 +14,8 @@ require (
 	k8s.io/client-go v12.0.0+incompatible
 	kubevirt.io/api v0.0.0-20230601140537-c247dbe8f8f4
 	kubevirt.io/client-go v0.59.1
+	kubevirt.io/containerized-data-importer-api v1.55.0
+	sigs.k8s.io/yaml v1.3.0
 )
 
 require (
@@ -60,11 +62,9 @@ require (
 	k8s.io/klog/v2 v2.40.1 // indirect
 	k8s.io/kube-openapi v0.0.0-20220124234850-424119656bbf // indirect
 	k8s.io/utils v0.0.0-20211116205334-6203023598ed // indirect
-	kubevirt.io/containerized-data-importer-api v1.55.0 // indirect
 	kubevirt.io/controller-lifecycle-operator-sdk/api v0.0.0-20220329064328-f3cc58c6ed90 // indirect
 	sigs.k8s.io/json v0.0.0-20211020170558-c049b76a60c6 // indirect
 	sigs.k8s.io/structured-merge-diff/v4 v4.2.1 // indirect
-	sigs.k8s.io/yaml v1.3.0 // indirect
 )
 
 replace (
@@ -0,0 +1,95 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	k8sapi "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// HotplugVolumes attaches the specified PVCs to the running job VM, and
+// waits until the guest can use them. The volumes are named after their PVC,
+// which is also used as the disk serial.
+func HotplugVolumes(
+	ctx context.Context,
+	client kubevirt.KubevirtClient,
+	jctx *JobContext,
+	vm *kubevirtapi.VirtualMachineInstance,
+	claims []string,
+) error {
+	if len(claims) == 0 {
+		return nil
+	}
+
+	for _, claim := range claims {
+		fmt.Fprintf(os.Stderr, "Attaching volume %s to Virtual Machine instance %s\n", claim, vm.ObjectMeta.Name)
+
+		err := client.VirtualMachineInstance(jctx.Namespace).AddVolume(ctx, vm.ObjectMeta.Name, &kubevirtapi.AddVolumeOptions{
+			Name: claim,
+			Disk: &kubevirtapi.Disk{
+				Name:   claim,
+				Serial: claim,
+				DiskDevice: kubevirtapi.DiskDevice{
+					// Hotplugged disks must be on the SCSI bus
+					Disk: &kubevirtapi.DiskTarget{Bus: kubevirtapi.DiskBusSCSI},
+				},
+			},
+			VolumeSource: &kubevirtapi.HotplugVolumeSource{
+				PersistentVolumeClaim: &kubevirtapi.PersistentVolumeClaimVolumeSource{
+					PersistentVolumeClaimVolumeSource: k8sapi.PersistentVolumeClaimVolumeSource{
+						ClaimName: claim,
+					},
+					Hotpluggable: true,
+				},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("attaching volume %s: %w", claim, err)
+		}
+	}
+
+	return WatchJobVM(ctx, client, jctx, vm, func(et watch.EventType, val *kubevirtapi.VirtualMachineInstance) error {
+		if et == watch.Error {
+			// Retry on watch failure
+			return nil
+		}
+		ready := 0
+		for _, status := range val.Status.VolumeStatus {
+			if contains(claims, status.Name) && status.Phase == kubevirtapi.VolumeReady {
+				ready++
+			}
+		}
+		if ready == len(claims) {
+			return ErrWatchDone
+		}
+		return nil
+	})
+}
+
+// UnplugVolumes detaches all hotplugged volumes from the job VM.
+func UnplugVolumes(ctx context.Context, client kubevirt.KubevirtClient, vm *kubevirtapi.VirtualMachineInstance) error {
+	for _, status := range vm.Status.VolumeStatus {
+		if status.HotplugVolume == nil {
+			continue
+		}
+
+		fmt.Fprintf(os.Stderr, "Detaching volume %s from Virtual Machine instance %s\n", status.Name, vm.ObjectMeta.Name)
+
+		err := client.VirtualMachineInstance(vm.ObjectMeta.Namespace).RemoveVolume(ctx, vm.ObjectMeta.Name, &kubevirtapi.RemoveVolumeOptions{
+			Name: status.Name,
+		})
+		if err != nil {
+			return fmt.Errorf("detaching volume %s: %w", status.Name, err)
+		}
+	}
+	return nil
+}
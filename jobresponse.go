@@ -0,0 +1,81 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	k8sapi "k8s.io/api/core/v1"
+)
+
+// JobResponse is the subset of the job payload sent by GitLab that the
+// driver cares about. gitlab-runner writes it to the file pointed to by
+// $JOB_RESPONSE_FILE in every stage.
+type JobResponse struct {
+	Variables []JobVariable `json:"variables"`
+	Image     JobImage      `json:"image"`
+	Services  []JobImage    `json:"services"`
+}
+
+type JobVariable struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Public bool   `json:"public"`
+	File   bool   `json:"file"`
+	Masked bool   `json:"masked"`
+}
+
+// JobImage describes the `image` and `services` of a job.
+type JobImage struct {
+	Name         string   `json:"name"`
+	Alias        string   `json:"alias"`
+	Command      []string `json:"command"`
+	Entrypoint   []string `json:"entrypoint"`
+	PullPolicies []string `json:"pull_policy"`
+}
+
+// LoadJobResponse reads the job payload from the specified file.
+func LoadJobResponse(path string) (*JobResponse, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading job response: %w", err)
+	}
+	var resp JobResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("parsing job response %s: %w", path, err)
+	}
+	return &resp, nil
+}
+
+// imagePullPolicy returns the pull policy of the image, if any. Unlike the
+// docker executor, only the first of the allowed pull policies is used.
+func imagePullPolicy(image JobImage) (k8sapi.PullPolicy, error) {
+	if len(image.PullPolicies) == 0 {
+		return "", nil
+	}
+	policy, err := parsePullPolicy(image.PullPolicies[0])
+	if err != nil {
+		return "", fmt.Errorf("image %s: %w", image.Name, err)
+	}
+	return policy, nil
+}
+
+// parsePullPolicy parses a pull policy, named either like in GitLab CI
+// (e.g. if-not-present) or like in Kubernetes (e.g. IfNotPresent).
+func parsePullPolicy(policy string) (k8sapi.PullPolicy, error) {
+	switch policy {
+	case "always", string(k8sapi.PullAlways):
+		return k8sapi.PullAlways, nil
+	case "if-not-present", string(k8sapi.PullIfNotPresent):
+		return k8sapi.PullIfNotPresent, nil
+	case "never", string(k8sapi.PullNever):
+		return k8sapi.PullNever, nil
+	default:
+		return "", fmt.Errorf("unsupported pull policy %q", policy)
+	}
+}
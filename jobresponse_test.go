@@ -0,0 +1,41 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	k8sapi "k8s.io/api/core/v1"
+)
+
+func TestParsePullPolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		want    k8sapi.PullPolicy
+		wantErr bool
+	}{
+		{"always", k8sapi.PullAlways, false},
+		{"Always", k8sapi.PullAlways, false},
+		{"if-not-present", k8sapi.PullIfNotPresent, false},
+		{"IfNotPresent", k8sapi.PullIfNotPresent, false},
+		{"never", k8sapi.PullNever, false},
+		{"Never", k8sapi.PullNever, false},
+		{"", "", true},
+		{"ALWAYS", "", true},
+		{"if_not_present", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			got, err := parsePullPolicy(tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePullPolicy(%q) error = %v, want error: %v", tt.policy, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parsePullPolicy(%q) = %q, want %q", tt.policy, got, tt.want)
+			}
+		})
+	}
+}
@@ -10,10 +10,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/cenkalti/backoff/v4"
 	k8sapi "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
@@ -22,13 +28,34 @@ import (
 	"k8s.io/client-go/util/homedir"
 	kubevirtapi "kubevirt.io/api/core/v1"
 	kubevirt "kubevirt.io/client-go/kubecli"
+	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
 )
 
 const (
 	labelPrefix = "gitlab-runner-kubevirt.snai.pe"
+
+	// DeadlineAnnotation holds the time past which the job of a VM has
+	// necessarily timed out.
+	DeadlineAnnotation = labelPrefix + "/deadline"
 )
 
 func KubeConfig() (*rest.Config, error) {
+	return KubeConfigForContext(cli.KubeContext)
+}
+
+// KubeConfigForContext returns the configuration of the cluster named by the
+// specified kubeconfig context, or of the current cluster if it is empty.
+func KubeConfigForContext(name string) (*rest.Config, error) {
+	if name != "" {
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		overrides := &clientcmd.ConfigOverrides{CurrentContext: name}
+		config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("kubeconfig context %s: %w", name, err)
+		}
+		return config, nil
+	}
+
 	config, err := rest.InClusterConfig()
 	if err == rest.ErrNotInCluster {
 		var kubeconfig string
@@ -48,10 +75,25 @@ func KubeConfig() (*rest.Config, error) {
 }
 
 func KubeClient() (kubevirt.KubevirtClient, error) {
-	cfg, err := KubeConfig()
+	return KubeClientForContext(cli.KubeContext)
+}
+
+// KubeClientForContext returns a client of the cluster named by the specified
+// kubeconfig context, or of the current cluster if it is empty.
+func KubeClientForContext(name string) (kubevirt.KubevirtClient, error) {
+	cfg, err := KubeConfigForContext(name)
 	if err != nil {
 		return nil, err
 	}
+
+	cfg.QPS = cli.KubeQPS
+	cfg.Burst = cli.KubeBurst
+	cfg.Timeout = cli.KubeTimeout
+	if cli.KubeRetries > 0 {
+		cfg.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+			return &retryTransport{next: rt, retries: cli.KubeRetries}
+		}
+	}
 	return kubevirt.GetKubevirtClientFromRESTConfig(cfg)
 }
 
@@ -62,6 +104,140 @@ func CreateJobVM(
 	rc *RunConfig,
 ) (*kubevirtapi.VirtualMachineInstance, error) {
 
+	runConfigJSON, err := json.Marshal(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	var instanceTemplate kubevirtapi.VirtualMachineInstance
+	var dataVolumes []kubevirtapi.DataVolumeTemplateSpec
+	if jctx.VMITemplate != "" {
+		if err := DecodeTemplate("VMI template", jctx.VMITemplate, jctx, &instanceTemplate); err != nil {
+			return nil, err
+		}
+	} else {
+		spec, err := DefaultJobVMSpec(jctx)
+		if err != nil {
+			return nil, err
+		}
+		instanceTemplate.Spec = *spec
+
+		dataVolumes, err = JobDataVolumes(jctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	instanceTemplate.TypeMeta = metav1.TypeMeta{
+		APIVersion: kubevirtapi.GroupVersion.String(),
+		Kind:       kubevirtapi.VirtualMachineInstanceGroupVersionKind.Kind,
+	}
+
+	meta := &instanceTemplate.ObjectMeta
+	if meta.Name == "" && meta.GenerateName == "" {
+		meta.Name = JobVMName(jctx)
+	}
+	meta.Namespace = jctx.Namespace
+
+	labels := map[string]string{
+		labelPrefix + "/id":      jctx.ID,
+		labelPrefix + "/project": jctx.ProjectID,
+	}
+	annotations := map[string]string{
+		// These annotations are set by the Kubernetes executor; borrow
+		// them for compatibility
+		"project.runner.gitlab.com/id":     jctx.ProjectID,
+		"job.runner.gitlab.com/id":         jctx.JobID,
+		"job.runner.gitlab.com/name":       jctx.JobName,
+		"job.runner.gitlab.com/ref":        jctx.JobRef,
+		"job.runner.gitlab.com/sha":        jctx.JobSha,
+		"job.runner.gitlab.com/before-sha": jctx.JobBeforeSha,
+		"job.runner.gitlab.com/url":        jctx.JobURL,
+
+		// These are owned by this runner.
+		labelPrefix + "/pipeline-url": jctx.PipelineURL,
+		RunConfigKey:                  string(runConfigJSON),
+		DriverVersionKey:              shortVersion(),
+	}
+
+	if jctx.Istio {
+		annotations["sidecar.istio.io/inject"] = "true"
+		annotations["traffic.sidecar.istio.io/kubevirtInterfaces"] = "k6t-eth0"
+		// The runner is not necessarily part of the mesh, so ssh must not
+		// go through the sidecar.
+		if rc.Method == "ssh" {
+			annotations["traffic.sidecar.istio.io/excludeInboundPorts"] = rc.SSH.Port
+		}
+	}
+
+	// The deadline lets VMs be told apart from the ones that outlived their
+	// job, e.g. when the runner died before cleaning them up.
+	if jctx.JobTimeout != 0 {
+		annotations[DeadlineAnnotation] = time.Now().Add(jctx.JobTimeout + jctx.TimeoutMargin).UTC().Format(time.RFC3339)
+	}
+
+	// Labels and annotations from the template and the job context are
+	// kept, but can't override the ones the runner relies on.
+	meta.Labels = mergeMaps(meta.Labels, jctx.Labels, labels)
+	meta.Annotations = mergeMaps(meta.Annotations, jctx.Annotations, annotations)
+
+	if jctx.VMIPatch != "" {
+		if err := PatchSpec(&instanceTemplate, jctx.VMIPatchType, jctx.VMIPatch); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := ValidateJobVMResources(ctx, client, jctx.Namespace, instanceTemplate.Spec.Domain.Resources); err != nil {
+		return nil, err
+	}
+
+	if jctx.Instancetype != "" || jctx.Preference != "" || len(dataVolumes) > 0 {
+		return createOwnedJobVM(ctx, client, jctx, &instanceTemplate, dataVolumes)
+	}
+
+	return client.VirtualMachineInstance(jctx.Namespace).Create(ctx, &instanceTemplate)
+}
+
+// RetryCreate calls create until it succeeds, fails with an error that isn't
+// transient, or the budget runs out. Exceeded quotas and unavailable admission
+// webhooks are considered transient, as they routinely happen during bursts of
+// jobs and clear up once concurrent jobs finish.
+func RetryCreate(ctx context.Context, what string, budget time.Duration, create func() error) error {
+	back := backoff.NewExponentialBackOff()
+	back.MaxInterval = 30 * time.Second
+	back.MaxElapsedTime = budget
+
+	operation := func() error {
+		err := create()
+		if err != nil && !isTransientCreateError(err) {
+			return backoff.Permanent(err)
+		}
+		return err
+	}
+	notify := func(err error, next time.Duration) {
+		fmt.Fprintf(os.Stderr, "Could not create %s, retrying in %v: %v\n", what, next.Round(time.Second), err)
+	}
+	return backoff.RetryNotify(operation, backoff.WithContext(back, ctx), notify)
+}
+
+func isTransientCreateError(err error) bool {
+	switch {
+	case k8serrors.IsForbidden(err):
+		return strings.Contains(err.Error(), "exceeded quota")
+	case k8serrors.IsConflict(err),
+		k8serrors.IsInternalError(err),
+		k8serrors.IsServerTimeout(err),
+		k8serrors.IsTimeout(err),
+		k8serrors.IsTooManyRequests(err),
+		k8serrors.IsServiceUnavailable(err):
+		return true
+	}
+	return false
+}
+
+// DefaultJobVMSpec returns the spec of job VMs when no VMI template has been
+// specified.
+func DefaultJobVMSpec(jctx *JobContext) (*kubevirtapi.VirtualMachineInstanceSpec, error) {
 	resources := kubevirtapi.ResourceRequirements{
 		Requests: k8sapi.ResourceList{},
 		Limits:   k8sapi.ResourceList{},
@@ -85,89 +261,989 @@ func CreateJobVM(
 		if e.Value == "" {
 			continue
 		}
+		// CPU and memory are owned by the instancetype; KubeVirt rejects
+		// VMs that try to set both.
+		if jctx.Instancetype != "" && (e.Key == k8sapi.ResourceCPU || e.Key == k8sapi.ResourceMemory) {
+			continue
+		}
 		var err error
 		if e.List[e.Key], err = resource.ParseQuantity(e.Value); err != nil {
 			return nil, fmt.Errorf("parsing %s quantity: %w", e.Key, err)
 		}
 	}
 
-	if jctx.Image == "" {
+	rootVolume := kubevirtapi.VolumeSource{
+		ContainerDisk: &kubevirtapi.ContainerDiskSource{
+			Image:           jctx.Image,
+			ImagePullPolicy: k8sapi.PullPolicy(jctx.ImagePullPolicy),
+			ImagePullSecret: jctx.ImagePullSecret,
+		},
+	}
+	if hasRootDataVolume(jctx) {
+		rootVolume = kubevirtapi.VolumeSource{
+			DataVolume: &kubevirtapi.DataVolumeSource{
+				Name: rootDataVolumeName(jctx),
+			},
+		}
+	} else if jctx.Image == "" {
 		return nil, fmt.Errorf("must specify a containerdisk image")
 	}
 
-	runConfigJSON, err := json.Marshal(rc)
+	rootDisk, err := diskTarget(jctx.RootDiskBus)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("root disk: %w", err)
 	}
 
-	timezone := kubevirtapi.ClockOffsetTimezone(jctx.Timezone)
+	spec := kubevirtapi.VirtualMachineInstanceSpec{
+		NodeSelector: jctx.NodeSelector,
+		Affinity:     jctx.Affinity,
 
-	instanceTemplate := kubevirtapi.VirtualMachineInstance{
-		TypeMeta: metav1.TypeMeta{
-			APIVersion: kubevirtapi.GroupVersion.String(),
-			Kind:       kubevirtapi.VirtualMachineInstanceGroupVersionKind.Kind,
-		},
-		ObjectMeta: metav1.ObjectMeta{
-			GenerateName: jctx.BaseName,
-			Labels: map[string]string{
-				labelPrefix + "/id": jctx.ID,
-			},
-			Annotations: map[string]string{
-				// These annotations are set by the Kubernetes executor; borrow
-				// them for compatibility
-				"project.runner.gitlab.com/id":     jctx.ProjectID,
-				"job.runner.gitlab.com/id":         jctx.JobID,
-				"job.runner.gitlab.com/name":       jctx.JobName,
-				"job.runner.gitlab.com/ref":        jctx.JobRef,
-				"job.runner.gitlab.com/sha":        jctx.JobSha,
-				"job.runner.gitlab.com/before-sha": jctx.JobBeforeSha,
-				"job.runner.gitlab.com/url":        jctx.JobURL,
-
-				// These are owned by this runner.
-				RunConfigKey: string(runConfigJSON),
+		PriorityClassName: jctx.PriorityClassName,
+		SchedulerName:     jctx.SchedulerName,
+
+		Hostname:  jctx.Hostname,
+		Subdomain: jctx.Subdomain,
+		DNSPolicy: k8sapi.DNSPolicy(jctx.DNSPolicy),
+		DNSConfig: jctx.DNSConfig,
+
+		TopologySpreadConstraints: jctx.TopologySpreadConstraints,
+
+		Domain: kubevirtapi.DomainSpec{
+			Resources: resources,
+			Machine: &kubevirtapi.Machine{
+				Type: jctx.MachineType,
 			},
-		},
-		Spec: kubevirtapi.VirtualMachineInstanceSpec{
-			Domain: kubevirtapi.DomainSpec{
-				Resources: resources,
-				Machine: &kubevirtapi.Machine{
-					Type: jctx.MachineType,
-				},
-				Devices: kubevirtapi.Devices{
-					Disks: []kubevirtapi.Disk{
-						{
-							Name: "root",
+			Devices: kubevirtapi.Devices{
+				Disks: []kubevirtapi.Disk{
+					{
+						Name: "root",
+						DiskDevice: kubevirtapi.DiskDevice{
+							Disk: rootDisk,
 						},
 					},
 				},
-				Clock: &kubevirtapi.Clock{
-					ClockOffset: kubevirtapi.ClockOffset{
-						Timezone: &timezone,
+			},
+			Clock: &kubevirtapi.Clock{},
+		},
+		Volumes: []kubevirtapi.Volume{
+			{
+				Name:         "root",
+				VolumeSource: rootVolume,
+			},
+		},
+	}
+
+	if jctx.HugepagesPageSize != "" || jctx.GuestMemory != "" {
+		spec.Domain.Memory = &kubevirtapi.Memory{}
+	}
+	if jctx.HugepagesPageSize != "" {
+		spec.Domain.Memory.Hugepages = &kubevirtapi.Hugepages{
+			PageSize: jctx.HugepagesPageSize,
+		}
+	}
+	if jctx.GuestMemory != "" {
+		guest, err := resource.ParseQuantity(jctx.GuestMemory)
+		if err != nil {
+			return nil, fmt.Errorf("parsing guest memory quantity: %w", err)
+		}
+		spec.Domain.Memory.Guest = &guest
+	}
+
+	switch jctx.ClockOffset {
+	case "utc":
+		spec.Domain.Clock.ClockOffset.UTC = &kubevirtapi.ClockOffsetUTC{}
+	default:
+		timezone := kubevirtapi.ClockOffsetTimezone(jctx.Timezone)
+		spec.Domain.Clock.ClockOffset.Timezone = &timezone
+	}
+
+	timer, err := parseTimers(jctx.Timers)
+	if err != nil {
+		return nil, err
+	}
+	spec.Domain.Clock.Timer = timer
+
+	domainCPU := func() *kubevirtapi.CPU {
+		if spec.Domain.CPU == nil {
+			spec.Domain.CPU = &kubevirtapi.CPU{}
+		}
+		return spec.Domain.CPU
+	}
+
+	if jctx.CPUModel != "" {
+		domainCPU().Model = jctx.CPUModel
+	}
+	if jctx.CPUSockets != 0 {
+		domainCPU().Sockets = jctx.CPUSockets
+	}
+	if jctx.CPUCores != 0 {
+		domainCPU().Cores = jctx.CPUCores
+	}
+	if jctx.CPUThreads != 0 {
+		domainCPU().Threads = jctx.CPUThreads
+	}
+	for _, feature := range jctx.CPUFeatures {
+		name, policy := feature, ""
+		if idx := strings.Index(feature, "="); idx != -1 {
+			name, policy = feature[:idx], feature[idx+1:]
+		}
+		switch policy {
+		case "", "force", "require", "optional", "disable", "forbid":
+		default:
+			return nil, fmt.Errorf("CPU feature %s: unknown policy %q", name, policy)
+		}
+		domainCPU().Features = append(domainCPU().Features, kubevirtapi.CPUFeature{
+			Name:   name,
+			Policy: policy,
+		})
+	}
+	if jctx.DedicatedCPUPlacement {
+		domainCPU().DedicatedCPUPlacement = true
+	}
+	if jctx.NUMAPassthrough {
+		if !jctx.DedicatedCPUPlacement || jctx.HugepagesPageSize == "" {
+			return nil, fmt.Errorf("NUMA passthrough requires dedicated CPU placement and hugepages")
+		}
+		domainCPU().NUMA = &kubevirtapi.NUMA{
+			GuestMappingPassthrough: &kubevirtapi.NUMAGuestMappingPassthrough{},
+		}
+	}
+
+	domainFeatures := func() *kubevirtapi.Features {
+		if spec.Domain.Features == nil {
+			spec.Domain.Features = &kubevirtapi.Features{}
+		}
+		return spec.Domain.Features
+	}
+
+	if jctx.SecureBoot && jctx.Firmware != "efi" {
+		return nil, fmt.Errorf("Secure Boot requires EFI firmware")
+	}
+	if jctx.Firmware == "efi" {
+		secureBoot := jctx.SecureBoot
+		spec.Domain.Firmware = &kubevirtapi.Firmware{
+			Bootloader: &kubevirtapi.Bootloader{
+				EFI: &kubevirtapi.EFI{
+					SecureBoot: &secureBoot,
+				},
+			},
+		}
+		if secureBoot {
+			// Secure Boot requires SMM
+			enabled := true
+			domainFeatures().SMM = &kubevirtapi.FeatureState{Enabled: &enabled}
+		}
+	}
+
+	if jctx.Hyperv {
+		// This is the set of enlightenments recommended for Windows guests
+		// by the KubeVirt common templates.
+		spinlocks := uint32(8191)
+		domainFeatures().Hyperv = &kubevirtapi.FeatureHyperv{
+			Relaxed:         &kubevirtapi.FeatureState{},
+			VAPIC:           &kubevirtapi.FeatureState{},
+			Spinlocks:       &kubevirtapi.FeatureSpinlocks{Retries: &spinlocks},
+			VPIndex:         &kubevirtapi.FeatureState{},
+			Runtime:         &kubevirtapi.FeatureState{},
+			SyNIC:           &kubevirtapi.FeatureState{},
+			SyNICTimer:      &kubevirtapi.SyNICTimer{Direct: &kubevirtapi.FeatureState{}},
+			Reset:           &kubevirtapi.FeatureState{},
+			Frequencies:     &kubevirtapi.FeatureState{},
+			Reenlightenment: &kubevirtapi.FeatureState{},
+			TLBFlush:        &kubevirtapi.FeatureState{},
+			IPI:             &kubevirtapi.FeatureState{},
+		}
+	}
+
+	if jctx.KVMHidden {
+		domainFeatures().KVM = &kubevirtapi.FeatureKVM{Hidden: true}
+	}
+	if jctx.HypervVendorID != "" {
+		if len(jctx.HypervVendorID) > 12 {
+			return nil, fmt.Errorf("Hyper-V vendor ID %q is longer than 12 characters", jctx.HypervVendorID)
+		}
+		features := domainFeatures()
+		if features.Hyperv == nil {
+			features.Hyperv = &kubevirtapi.FeatureHyperv{}
+		}
+		features.Hyperv.VendorID = &kubevirtapi.FeatureVendorID{VendorID: jctx.HypervVendorID}
+	}
+
+	if jctx.RNG {
+		// Gives the guest a source of entropy, without which it may stall
+		// during boot, typically while generating ssh host keys.
+		spec.Domain.Devices.Rng = &kubevirtapi.Rng{}
+	}
+	if jctx.TPM {
+		spec.Domain.Devices.TPM = &kubevirtapi.TPMDevice{}
+	}
+
+	deviceNames := make([]string, 0, len(jctx.GPUs))
+	for deviceName := range jctx.GPUs {
+		deviceNames = append(deviceNames, deviceName)
+	}
+	sort.Strings(deviceNames)
+
+	for _, deviceName := range deviceNames {
+		for i := 0; i < jctx.GPUs[deviceName]; i++ {
+			spec.Domain.Devices.GPUs = append(spec.Domain.Devices.GPUs, kubevirtapi.GPU{
+				Name:       fmt.Sprintf("gpu%d", len(spec.Domain.Devices.GPUs)),
+				DeviceName: deviceName,
+			})
+		}
+	}
+
+	if jctx.Istio {
+		// Istio only supports the masquerade binding, which KubeVirt doesn't
+		// necessarily default to.
+		addPodNetwork(&spec)
+	}
+
+	for _, network := range jctx.Networks {
+		if err := addMultusInterface(&spec, network); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, image := range jctx.ContainerDisks {
+		bus := ""
+		if idx := strings.LastIndex(image, "="); idx != -1 {
+			image, bus = image[:idx], image[idx+1:]
+		}
+		target, err := diskTarget(bus)
+		if err != nil {
+			return nil, fmt.Errorf("containerdisk %s: %w", image, err)
+		}
+
+		name := fmt.Sprintf("containerdisk%d", i+1)
+		spec.Domain.Devices.Disks = append(spec.Domain.Devices.Disks, kubevirtapi.Disk{
+			Name: name,
+			DiskDevice: kubevirtapi.DiskDevice{
+				Disk: target,
+			},
+		})
+		spec.Volumes = append(spec.Volumes, kubevirtapi.Volume{
+			Name: name,
+			VolumeSource: kubevirtapi.VolumeSource{
+				ContainerDisk: &kubevirtapi.ContainerDiskSource{
+					Image:           image,
+					ImagePullPolicy: k8sapi.PullPolicy(jctx.ImagePullPolicy),
+					ImagePullSecret: jctx.ImagePullSecret,
+				},
+			},
+		})
+	}
+
+	if jctx.ScratchDiskSize != "" {
+		size, err := resource.ParseQuantity(jctx.ScratchDiskSize)
+		if err != nil {
+			return nil, fmt.Errorf("parsing scratch disk size: %w", err)
+		}
+
+		// The scratch disk is always attached through virtio, so that it
+		// can be found by serial at scratchDiskDevice.
+		spec.Domain.Devices.Disks = append(spec.Domain.Devices.Disks, kubevirtapi.Disk{
+			Name:   "scratch",
+			Serial: "scratch",
+			DiskDevice: kubevirtapi.DiskDevice{
+				Disk: &kubevirtapi.DiskTarget{Bus: kubevirtapi.DiskBusVirtio},
+			},
+		})
+		spec.Volumes = append(spec.Volumes, kubevirtapi.Volume{
+			Name: "scratch",
+			VolumeSource: kubevirtapi.VolumeSource{
+				EmptyDisk: &kubevirtapi.EmptyDiskSource{
+					Capacity: size,
+				},
+			},
+		})
+	}
+
+	if jctx.CacheClaim != "" {
+		spec.Domain.Devices.Disks = append(spec.Domain.Devices.Disks, kubevirtapi.Disk{
+			Name:   "cache",
+			Serial: "cache",
+			DiskDevice: kubevirtapi.DiskDevice{
+				Disk: &kubevirtapi.DiskTarget{Bus: kubevirtapi.DiskBusVirtio},
+			},
+		})
+		spec.Volumes = append(spec.Volumes, kubevirtapi.Volume{
+			Name: "cache",
+			VolumeSource: kubevirtapi.VolumeSource{
+				PersistentVolumeClaim: &kubevirtapi.PersistentVolumeClaimVolumeSource{
+					PersistentVolumeClaimVolumeSource: k8sapi.PersistentVolumeClaimVolumeSource{
+						ClaimName: jctx.CacheClaim,
 					},
-					Timer: &kubevirtapi.Timer{
-						Hyperv: &kubevirtapi.HypervTimer{},
-						RTC: &kubevirtapi.RTCTimer{
-							TickPolicy: kubevirtapi.RTCTickPolicy("catchup"),
-						},
+				},
+			},
+		})
+	}
+
+	if jctx.BuildsClaim != "" {
+		spec.Domain.Devices.Filesystems = append(spec.Domain.Devices.Filesystems, kubevirtapi.Filesystem{
+			Name:     "builds",
+			Virtiofs: &kubevirtapi.FilesystemVirtiofs{},
+		})
+		spec.Volumes = append(spec.Volumes, kubevirtapi.Volume{
+			Name: "builds",
+			VolumeSource: kubevirtapi.VolumeSource{
+				PersistentVolumeClaim: &kubevirtapi.PersistentVolumeClaimVolumeSource{
+					PersistentVolumeClaimVolumeSource: k8sapi.PersistentVolumeClaimVolumeSource{
+						ClaimName: jctx.BuildsClaim,
 					},
 				},
 			},
-			Volumes: []kubevirtapi.Volume{
-				{
-					Name: "root",
-					VolumeSource: kubevirtapi.VolumeSource{
-						ContainerDisk: &kubevirtapi.ContainerDiskSource{
-							Image:           jctx.Image,
-							ImagePullPolicy: k8sapi.PullPolicy(jctx.ImagePullPolicy),
-							ImagePullSecret: jctx.ImagePullSecret,
-						},
+		})
+	}
+
+	for i, configMap := range jctx.ConfigMaps {
+		name, label := splitVolumeLabel(configMap)
+		volumeName := fmt.Sprintf("configmap%d", i+1)
+		spec.Domain.Devices.Disks = append(spec.Domain.Devices.Disks, kubevirtapi.Disk{
+			Name:   volumeName,
+			Serial: name,
+		})
+		spec.Volumes = append(spec.Volumes, kubevirtapi.Volume{
+			Name: volumeName,
+			VolumeSource: kubevirtapi.VolumeSource{
+				ConfigMap: &kubevirtapi.ConfigMapVolumeSource{
+					LocalObjectReference: k8sapi.LocalObjectReference{Name: name},
+					VolumeLabel:          label,
+				},
+			},
+		})
+	}
+
+	for i, secret := range jctx.Secrets {
+		name, label := splitVolumeLabel(secret)
+		volumeName := fmt.Sprintf("secret%d", i+1)
+		spec.Domain.Devices.Disks = append(spec.Domain.Devices.Disks, kubevirtapi.Disk{
+			Name:   volumeName,
+			Serial: name,
+		})
+		spec.Volumes = append(spec.Volumes, kubevirtapi.Volume{
+			Name: volumeName,
+			VolumeSource: kubevirtapi.VolumeSource{
+				Secret: &kubevirtapi.SecretVolumeSource{
+					SecretName:  name,
+					VolumeLabel: label,
+				},
+			},
+		})
+	}
+
+	if jctx.DownwardAPI {
+		fieldFile := func(path, field string) k8sapi.DownwardAPIVolumeFile {
+			return k8sapi.DownwardAPIVolumeFile{
+				Path:     path,
+				FieldRef: &k8sapi.ObjectFieldSelector{FieldPath: field},
+			}
+		}
+
+		spec.Domain.Devices.Disks = append(spec.Domain.Devices.Disks, kubevirtapi.Disk{
+			Name: "metadata",
+		})
+		spec.Volumes = append(spec.Volumes, kubevirtapi.Volume{
+			Name: "metadata",
+			VolumeSource: kubevirtapi.VolumeSource{
+				DownwardAPI: &kubevirtapi.DownwardAPIVolumeSource{
+					Fields: []k8sapi.DownwardAPIVolumeFile{
+						fieldFile("name", "metadata.name"),
+						fieldFile("namespace", "metadata.namespace"),
+						fieldFile("labels", "metadata.labels"),
+						fieldFile("annotations", "metadata.annotations"),
 					},
+					VolumeLabel: "metadata",
+				},
+			},
+		})
+	}
+
+	if jctx.ServiceAccount != "" {
+		// This also runs the VM pod as the service account
+		spec.Domain.Devices.Disks = append(spec.Domain.Devices.Disks, kubevirtapi.Disk{
+			Name: "serviceaccount",
+		})
+		spec.Volumes = append(spec.Volumes, kubevirtapi.Volume{
+			Name: "serviceaccount",
+			VolumeSource: kubevirtapi.VolumeSource{
+				ServiceAccount: &kubevirtapi.ServiceAccountVolumeSource{
+					ServiceAccountName: jctx.ServiceAccount,
+				},
+			},
+		})
+	}
+
+	if jctx.CloudInitUserData != "" || jctx.CloudInitUserDataSecret != "" {
+		var secretRef *k8sapi.LocalObjectReference
+		if jctx.CloudInitUserDataSecret != "" {
+			secretRef = &k8sapi.LocalObjectReference{
+				Name: jctx.CloudInitUserDataSecret,
+			}
+		}
+
+		var source kubevirtapi.VolumeSource
+		switch jctx.CloudInitType {
+		case "configdrive":
+			source.CloudInitConfigDrive = &kubevirtapi.CloudInitConfigDriveSource{
+				UserData:          jctx.CloudInitUserData,
+				UserDataSecretRef: secretRef,
+			}
+		default:
+			source.CloudInitNoCloud = &kubevirtapi.CloudInitNoCloudSource{
+				UserData:          jctx.CloudInitUserData,
+				UserDataSecretRef: secretRef,
+			}
+		}
+
+		spec.Domain.Devices.Disks = append(spec.Domain.Devices.Disks, kubevirtapi.Disk{
+			Name: "cloudinit",
+		})
+		spec.Volumes = append(spec.Volumes, kubevirtapi.Volume{
+			Name:         "cloudinit",
+			VolumeSource: source,
+		})
+	}
+
+	if jctx.SysprepConfigMap != "" || jctx.SysprepSecret != "" {
+		source := &kubevirtapi.SysprepSource{}
+		if jctx.SysprepConfigMap != "" {
+			source.ConfigMap = &k8sapi.LocalObjectReference{Name: jctx.SysprepConfigMap}
+		}
+		if jctx.SysprepSecret != "" {
+			source.Secret = &k8sapi.LocalObjectReference{Name: jctx.SysprepSecret}
+		}
+
+		spec.Domain.Devices.Disks = append(spec.Domain.Devices.Disks, kubevirtapi.Disk{
+			Name: "sysprep",
+			DiskDevice: kubevirtapi.DiskDevice{
+				CDRom: &kubevirtapi.CDRomTarget{
+					Bus: kubevirtapi.DiskBusSATA,
+				},
+			},
+		})
+		spec.Volumes = append(spec.Volumes, kubevirtapi.Volume{
+			Name: "sysprep",
+			VolumeSource: kubevirtapi.VolumeSource{
+				Sysprep: source,
+			},
+		})
+	}
+
+	if jctx.VirtioDriversImage != "" {
+		spec.Domain.Devices.Disks = append(spec.Domain.Devices.Disks, kubevirtapi.Disk{
+			Name: "virtio-drivers",
+			DiskDevice: kubevirtapi.DiskDevice{
+				CDRom: &kubevirtapi.CDRomTarget{
+					Bus: kubevirtapi.DiskBusSATA,
 				},
 			},
+		})
+		spec.Volumes = append(spec.Volumes, kubevirtapi.Volume{
+			Name: "virtio-drivers",
+			VolumeSource: kubevirtapi.VolumeSource{
+				ContainerDisk: &kubevirtapi.ContainerDiskSource{
+					Image:           jctx.VirtioDriversImage,
+					ImagePullPolicy: k8sapi.PullPolicy(jctx.ImagePullPolicy),
+					ImagePullSecret: jctx.ImagePullSecret,
+				},
+			},
+		})
+	}
+
+	if err := setBootOrder(&spec, jctx.BootOrder); err != nil {
+		return nil, err
+	}
+
+	if jctx.TerminationGracePeriod != 0 {
+		seconds := int64(jctx.TerminationGracePeriod / time.Second)
+		spec.TerminationGracePeriodSeconds = &seconds
+	}
+
+	switch strategy := kubevirtapi.EvictionStrategy(jctx.EvictionStrategy); strategy {
+	case "":
+	case kubevirtapi.EvictionStrategyNone, kubevirtapi.EvictionStrategyLiveMigrate, kubevirtapi.EvictionStrategyExternal:
+		spec.EvictionStrategy = &strategy
+	default:
+		return nil, fmt.Errorf("unsupported eviction strategy %q", jctx.EvictionStrategy)
+	}
+
+	switch policy := kubevirtapi.IOThreadsPolicy(jctx.IOThreadsPolicy); policy {
+	case "":
+	case kubevirtapi.IOThreadsPolicyShared, kubevirtapi.IOThreadsPolicyAuto:
+		spec.Domain.IOThreadsPolicy = &policy
+	default:
+		return nil, fmt.Errorf("unsupported IO threads policy %q", jctx.IOThreadsPolicy)
+	}
+	for _, name := range jctx.DedicatedIOThreads {
+		found := false
+		for i := range spec.Domain.Devices.Disks {
+			if disk := &spec.Domain.Devices.Disks[i]; disk.Name == name {
+				dedicated := true
+				disk.DedicatedIOThread = &dedicated
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("dedicated IO threads: no disk named %q", name)
+		}
+	}
+	if jctx.BlockMultiQueue {
+		spec.Domain.Devices.BlockMultiQueue = &jctx.BlockMultiQueue
+	}
+
+	if jctx.Preference != "" {
+		// Preferences only apply to fields left unset in the instance spec,
+		// so leave the clock and machine type up to them.
+		spec.Domain.Clock = nil
+		if jctx.MachineType == "" {
+			spec.Domain.Machine = nil
+		}
+	}
+
+	return &spec, nil
+}
+
+// hasRootDataVolume returns whether the root disk of the job VM is a
+// DataVolume rather than a containerdisk.
+func hasRootDataVolume(jctx *JobContext) bool {
+	return jctx.RootPVC != "" || jctx.RootDataSource != "" || jctx.RootSnapshot != "" || isImportedImage(jctx.Image)
+}
+
+// isImportedImage returns whether the image is a disk image that CDI must
+// import, rather than a containerdisk.
+func isImportedImage(image string) bool {
+	for _, scheme := range []string{"http://", "https://", "docker://"} {
+		if strings.HasPrefix(image, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// JobVMName returns the name of the job VM, unless a VMI template names it
+// otherwise. It is derived from the job context, so that it is known before
+// the VM gets created.
+func JobVMName(jctx *JobContext) string {
+	return fmt.Sprintf("%s-%s", jctx.BaseName, jctx.ID[:8])
+}
+
+func rootDataVolumeName(jctx *JobContext) string {
+	return JobVMName(jctx) + "-root"
+}
+
+// JobDataVolumes returns the DataVolumes to create along with the job VM.
+// They are owned by the VirtualMachine of the job, and get deleted with it.
+func JobDataVolumes(jctx *JobContext) ([]kubevirtapi.DataVolumeTemplateSpec, error) {
+	if !hasRootDataVolume(jctx) {
+		return nil, nil
+	}
+
+	storage, err := jobStorageSpec(jctx)
+	if err != nil {
+		return nil, err
+	}
+	spec := cdiv1.DataVolumeSpec{
+		// Unless specified, the size of clones is inferred from their source
+		Storage: storage,
+	}
+	if jctx.RootDiskSize != "" {
+		size, err := resource.ParseQuantity(jctx.RootDiskSize)
+		if err != nil {
+			return nil, fmt.Errorf("parsing root disk size: %w", err)
+		}
+		spec.Storage.Resources.Requests = k8sapi.ResourceList{
+			k8sapi.ResourceStorage: size,
+		}
+	}
+
+	sources := 0
+	for _, source := range []string{jctx.RootPVC, jctx.RootDataSource, jctx.RootSnapshot} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return nil, fmt.Errorf("the root disk can only be cloned from one of a PVC, a DataSource, or a VolumeSnapshot")
+	}
+
+	switch {
+	case jctx.RootPVC != "":
+		namespace, name := splitNamespacedName(jctx.RootPVC, jctx.Namespace)
+		spec.Source = &cdiv1.DataVolumeSource{
+			PVC: &cdiv1.DataVolumeSourcePVC{
+				Namespace: namespace,
+				Name:      name,
+			},
+		}
+	case jctx.RootDataSource != "":
+		namespace, name := splitNamespacedName(jctx.RootDataSource, jctx.Namespace)
+		spec.SourceRef = &cdiv1.DataVolumeSourceRef{
+			Kind:      cdiv1.DataVolumeDataSource,
+			Namespace: &namespace,
+			Name:      name,
+		}
+	case jctx.RootSnapshot != "":
+		if jctx.RootDiskSize == "" {
+			return nil, fmt.Errorf("restoring the root disk from a VolumeSnapshot requires a root disk size")
+		}
+		// The snapshot is restored by the CSI driver, which makes this
+		// much faster than populating the disk from scratch.
+		apiGroup := "snapshot.storage.k8s.io"
+		spec.Storage.DataSource = &k8sapi.TypedLocalObjectReference{
+			APIGroup: &apiGroup,
+			Kind:     "VolumeSnapshot",
+			Name:     jctx.RootSnapshot,
+		}
+	case jctx.RootDiskSize == "":
+		return nil, fmt.Errorf("importing %s requires a root disk size", jctx.Image)
+	case strings.HasPrefix(jctx.Image, "docker://"):
+		url := jctx.Image
+		spec.Source = &cdiv1.DataVolumeSource{
+			Registry: &cdiv1.DataVolumeSourceRegistry{
+				URL: &url,
+			},
+		}
+	default:
+		spec.Source = &cdiv1.DataVolumeSource{
+			HTTP: &cdiv1.DataVolumeSourceHTTP{
+				URL: jctx.Image,
+			},
+		}
+	}
+
+	return []kubevirtapi.DataVolumeTemplateSpec{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: rootDataVolumeName(jctx),
+				Labels: map[string]string{
+					labelPrefix + "/id":      jctx.ID,
+					labelPrefix + "/project": jctx.ProjectID,
+				},
+			},
+			Spec: spec,
 		},
+	}, nil
+}
+
+// jobStorageSpec returns the storage class, volume mode and access modes of
+// the volumes created for the job VM. Unset fields are left up to the
+// cluster defaults, or to the storage profile of the storage class.
+func jobStorageSpec(jctx *JobContext) (*cdiv1.StorageSpec, error) {
+	var storage cdiv1.StorageSpec
+	if jctx.StorageClassName != "" {
+		storage.StorageClassName = &jctx.StorageClassName
+	}
+	switch mode := k8sapi.PersistentVolumeMode(jctx.VolumeMode); mode {
+	case "":
+	case k8sapi.PersistentVolumeBlock, k8sapi.PersistentVolumeFilesystem:
+		storage.VolumeMode = &mode
+	default:
+		return nil, fmt.Errorf("unsupported volume mode %q", jctx.VolumeMode)
+	}
+	for _, mode := range jctx.AccessModes {
+		switch mode := k8sapi.PersistentVolumeAccessMode(mode); mode {
+		case k8sapi.ReadWriteOnce, k8sapi.ReadOnlyMany, k8sapi.ReadWriteMany, k8sapi.ReadWriteOncePod:
+			storage.AccessModes = append(storage.AccessModes, mode)
+		default:
+			return nil, fmt.Errorf("unsupported access mode %q", mode)
+		}
+	}
+	return &storage, nil
+}
+
+// dnsLabel turns the specified string into a valid DNS label, by lowercasing
+// it, replacing invalid characters with dashes, and truncating it to 63
+// characters.
+func dnsLabel(s string) string {
+	label := []byte(strings.ToLower(s))
+	for i, c := range label {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			label[i] = '-'
+		}
+	}
+	if len(label) > 63 {
+		label = label[:63]
 	}
+	return strings.Trim(string(label), "-")
+}
 
-	return client.VirtualMachineInstance(jctx.Namespace).Create(ctx, &instanceTemplate)
+// splitVolumeLabel splits a <name>[=<volume label>] reference to a
+// ConfigMap or Secret. The volume label defaults to the name.
+func splitVolumeLabel(ref string) (name, label string) {
+	if idx := strings.Index(ref, "="); idx != -1 {
+		return ref[:idx], ref[idx+1:]
+	}
+	return ref, ref
+}
+
+// splitNamespacedName splits a [<namespace>/]<name> reference, defaulting to
+// the specified namespace.
+func splitNamespacedName(ref, defaultNamespace string) (namespace, name string) {
+	if idx := strings.Index(ref, "/"); idx != -1 {
+		return ref[:idx], ref[idx+1:]
+	}
+	return defaultNamespace, ref
+}
+
+const (
+	// scratchDiskDevice is the path of the scratch disk in the guest.
+	scratchDiskDevice = "/dev/disk/by-id/virtio-scratch"
+
+	// cacheDevice is the path of the cache volume in the guest.
+	cacheDevice = "/dev/disk/by-id/virtio-cache"
+)
+
+// diskTarget returns the disk target for the specified bus, or nil if the bus
+// is empty, in which case KubeVirt picks the default bus.
+func diskTarget(bus string) (*kubevirtapi.DiskTarget, error) {
+	switch kubevirtapi.DiskBus(bus) {
+	case "":
+		return nil, nil
+	case kubevirtapi.DiskBusVirtio, kubevirtapi.DiskBusSATA, kubevirtapi.DiskBusSCSI:
+		return &kubevirtapi.DiskTarget{Bus: kubevirtapi.DiskBus(bus)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported disk bus %q", bus)
+	}
+}
+
+// setBootOrder assigns boot order indices to the named disks and interfaces
+// of the VM, in the order they are specified.
+func setBootOrder(spec *kubevirtapi.VirtualMachineInstanceSpec, names []string) error {
+	for i, name := range names {
+		order := uint(i + 1)
+		found := false
+		for j := range spec.Domain.Devices.Disks {
+			if disk := &spec.Domain.Devices.Disks[j]; disk.Name == name {
+				disk.BootOrder = &order
+				found = true
+			}
+		}
+		for j := range spec.Domain.Devices.Interfaces {
+			if iface := &spec.Domain.Devices.Interfaces[j]; iface.Name == name {
+				iface.BootOrder = &order
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("boot order: no disk or interface named %q", name)
+		}
+	}
+	return nil
+}
+
+// parseTimers parses <name>[=<tick policy>|off] timer specifications.
+func parseTimers(timers []string) (*kubevirtapi.Timer, error) {
+	var timer kubevirtapi.Timer
+	for _, spec := range timers {
+		name, policy := spec, ""
+		if idx := strings.Index(spec, "="); idx != -1 {
+			name, policy = spec[:idx], spec[idx+1:]
+		}
+
+		var present *bool
+		if policy == "off" {
+			present, policy = new(bool), ""
+		}
+
+		var validPolicies []string
+		switch name {
+		case "hpet":
+			timer.HPET = &kubevirtapi.HPETTimer{Enabled: present, TickPolicy: kubevirtapi.HPETTickPolicy(policy)}
+			validPolicies = []string{"delay", "catchup", "merge", "discard"}
+		case "pit":
+			timer.PIT = &kubevirtapi.PITTimer{Enabled: present, TickPolicy: kubevirtapi.PITTickPolicy(policy)}
+			validPolicies = []string{"delay", "catchup", "discard"}
+		case "rtc":
+			timer.RTC = &kubevirtapi.RTCTimer{Enabled: present, TickPolicy: kubevirtapi.RTCTickPolicy(policy)}
+			validPolicies = []string{"delay", "catchup"}
+		case "kvm":
+			timer.KVM = &kubevirtapi.KVMTimer{Enabled: present}
+		case "hyperv":
+			timer.Hyperv = &kubevirtapi.HypervTimer{Enabled: present}
+		default:
+			return nil, fmt.Errorf("unknown timer %q", name)
+		}
+
+		if policy != "" && !contains(validPolicies, policy) {
+			return nil, fmt.Errorf("timer %s: unsupported tick policy %q", name, policy)
+		}
+	}
+	return &timer, nil
+}
+
+// NetworkAttachment describes a secondary Multus network of a job VM.
+type NetworkAttachment struct {
+	// NetworkName is the name of the NetworkAttachmentDefinition, optionally
+	// prefixed with its namespace.
+	NetworkName string
+
+	// Binding is the interface binding method used to connect the VM to the
+	// network.
+	Binding string
+
+	// Default makes the network replace the pod network as the primary
+	// network of the VM.
+	Default bool
+}
+
+// addMultusInterface attaches the VM to the specified Multus network. Since
+// KubeVirt only adds the pod network to VMs that do not specify any network,
+// it gets added explicitly first, so that it keeps being the primary
+// interface of the VM.
+func addMultusInterface(spec *kubevirtapi.VirtualMachineInstanceSpec, network NetworkAttachment) error {
+	var binding kubevirtapi.InterfaceBindingMethod
+	switch network.Binding {
+	case "bridge":
+		binding.Bridge = &kubevirtapi.InterfaceBridge{}
+	case "masquerade":
+		binding.Masquerade = &kubevirtapi.InterfaceMasquerade{}
+	case "sriov":
+		binding.SRIOV = &kubevirtapi.InterfaceSRIOV{}
+	case "macvtap":
+		binding.Macvtap = &kubevirtapi.InterfaceMacvtap{}
+	default:
+		return fmt.Errorf("network %s: unsupported interface binding %q", network.NetworkName, network.Binding)
+	}
+
+	name := fmt.Sprintf("net%d", len(spec.Networks))
+	if network.Default {
+		name = "default"
+	} else {
+		addPodNetwork(spec)
+	}
+
+	spec.Networks = append(spec.Networks, kubevirtapi.Network{
+		Name: name,
+		NetworkSource: kubevirtapi.NetworkSource{
+			Multus: &kubevirtapi.MultusNetwork{
+				NetworkName: network.NetworkName,
+				Default:     network.Default,
+			},
+		},
+	})
+	spec.Domain.Devices.Interfaces = append(spec.Domain.Devices.Interfaces, kubevirtapi.Interface{
+		Name:                   name,
+		InterfaceBindingMethod: binding,
+	})
+	return nil
+}
+
+// addPodNetwork explicitly attaches the VM to the pod network in masquerade
+// mode, unless it already specifies its networks.
+func addPodNetwork(spec *kubevirtapi.VirtualMachineInstanceSpec) {
+	if len(spec.Networks) == 0 {
+		spec.Networks = append(spec.Networks, *kubevirtapi.DefaultPodNetwork())
+		spec.Domain.Devices.Interfaces = append(spec.Domain.Devices.Interfaces, *kubevirtapi.DefaultMasqueradeNetworkInterface())
+	}
+}
+
+// createOwnedJobVM creates a VirtualMachine wrapping the given instance
+// template, and lets the KubeVirt controller create the actual instance.
+// This is necessary for features like instancetypes and preferences, which
+// only apply to VirtualMachines, or DataVolume templates.
+func createOwnedJobVM(
+	ctx context.Context,
+	client kubevirt.KubevirtClient,
+	jctx *JobContext,
+	instanceTemplate *kubevirtapi.VirtualMachineInstance,
+	dataVolumes []kubevirtapi.DataVolumeTemplateSpec,
+) (*kubevirtapi.VirtualMachineInstance, error) {
+
+	runStrategy := kubevirtapi.RunStrategyOnce
+
+	vmTemplate := kubevirtapi.VirtualMachine{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: kubevirtapi.GroupVersion.String(),
+			Kind:       kubevirtapi.VirtualMachineGroupVersionKind.Kind,
+		},
+		ObjectMeta: instanceTemplate.ObjectMeta,
+		Spec: kubevirtapi.VirtualMachineSpec{
+			RunStrategy: &runStrategy,
+			Template: &kubevirtapi.VirtualMachineInstanceTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      instanceTemplate.ObjectMeta.Labels,
+					Annotations: instanceTemplate.ObjectMeta.Annotations,
+				},
+				Spec: instanceTemplate.Spec,
+			},
+			DataVolumeTemplates: dataVolumes,
+		},
+	}
+
+	if jctx.Instancetype != "" {
+		vmTemplate.Spec.Instancetype = &kubevirtapi.InstancetypeMatcher{
+			Name: jctx.Instancetype,
+			Kind: jctx.InstancetypeKind,
+		}
+
+		// Like CPU and memory resources, the CPU topology and guest
+		// memory are owned by the instancetype.
+		domain := &vmTemplate.Spec.Template.Spec.Domain
+		if domain.CPU != nil {
+			cpu := *domain.CPU
+			cpu.Sockets, cpu.Cores, cpu.Threads = 0, 0, 0
+			domain.CPU = &cpu
+		}
+		if domain.Memory != nil {
+			memory := *domain.Memory
+			memory.Guest = nil
+			domain.Memory = &memory
+		}
+	}
+	if jctx.Preference != "" {
+		vmTemplate.Spec.Preference = &kubevirtapi.PreferenceMatcher{
+			Name: jctx.Preference,
+			Kind: jctx.PreferenceKind,
+		}
+	}
+
+	vm, err := client.VirtualMachine(jctx.Namespace).Create(&vmTemplate)
+	switch {
+	case k8serrors.IsAlreadyExists(err):
+		// A previous attempt at preparing the job got to create the
+		// VirtualMachine, but not its instance yet.
+		fmt.Fprintf(os.Stderr, "Adopting existing Virtual Machine %s\n", vmTemplate.ObjectMeta.Name)
+		vm, err = client.VirtualMachine(jctx.Namespace).Get(vmTemplate.ObjectMeta.Name, &metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	}
+
+	// The instance does not exist yet, but will be created by the KubeVirt
+	// controller with the same name as its VirtualMachine. Objects that need
+	// an owner before then, like ephemeral ssh keys, are owned by the
+	// VirtualMachine.
+	controller := true
+	return &kubevirtapi.VirtualMachineInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      vm.ObjectMeta.Name,
+			Namespace: vm.ObjectMeta.Namespace,
+			Labels:    vm.Spec.Template.ObjectMeta.Labels,
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: kubevirtapi.GroupVersion.String(),
+					Kind:       kubevirtapi.VirtualMachineGroupVersionKind.Kind,
+					Name:       vm.ObjectMeta.Name,
+					UID:        vm.ObjectMeta.UID,
+					Controller: &controller,
+				},
+			},
+		},
+	}, nil
+}
+
+// OwnerVM returns the name of the VirtualMachine controlling the specified
+// instance, if any.
+func OwnerVM(vmi *kubevirtapi.VirtualMachineInstance) (string, bool) {
+	for _, ref := range vmi.ObjectMeta.OwnerReferences {
+		if ref.Kind == kubevirtapi.VirtualMachineGroupVersionKind.Kind && ref.Controller != nil && *ref.Controller {
+			return ref.Name, true
+		}
+	}
+	return "", false
 }
 
 func Selector(jctx *JobContext) *metav1.ListOptions {
@@ -183,16 +1259,187 @@ func FindJobVM(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobCon
 	}
 
 	if len(list.Items) == 0 {
-		return nil, fmt.Errorf("Virtual Machine instance disappeared while the job was running!")
+		return nil, ErrJobVMNotFound
 	}
 	if len(list.Items) > 1 {
-		return nil, fmt.Errorf("Virtual Machine instance has ambiguous ID! %d instances found with ID %v", len(list.Items), jctx.ID)
+		return resolveDuplicateJobVMs(ctx, client, jctx, list.Items), nil
 	}
 	return &list.Items[0], nil
 }
 
-var ErrWatchDone = errors.New("watch done")
+// resolveDuplicateJobVMs keeps one of the instances found with the ID of the
+// job, and deletes the others. Running instances are kept over the ones that
+// aren't, which are kept over the ones being deleted, and newer instances
+// over older ones.
+func resolveDuplicateJobVMs(
+	ctx context.Context,
+	client kubevirt.KubevirtClient,
+	jctx *JobContext,
+	vms []kubevirtapi.VirtualMachineInstance,
+) *kubevirtapi.VirtualMachineInstance {
+	rank := func(vm *kubevirtapi.VirtualMachineInstance) int {
+		switch {
+		case vm.ObjectMeta.DeletionTimestamp != nil:
+			return 0
+		case vm.Status.Phase != kubevirtapi.Running:
+			return 1
+		}
+		return 2
+	}
+	sort.SliceStable(vms, func(i, j int) bool {
+		if ri, rj := rank(&vms[i]), rank(&vms[j]); ri != rj {
+			return ri > rj
+		}
+		return vms[j].ObjectMeta.CreationTimestamp.Before(&vms[i].ObjectMeta.CreationTimestamp)
+	})
 
+	keep := &vms[0]
+	keepOwner, _ := OwnerVM(keep)
+	fmt.Fprintf(os.Stderr, "Found %d Virtual Machine instances with ID %v, keeping %s\n", len(vms), jctx.ID, keep.ObjectMeta.Name)
+	for i := range vms[1:] {
+		vm := &vms[i+1]
+		if vm.ObjectMeta.DeletionTimestamp != nil {
+			continue
+		}
+		if owner, ok := OwnerVM(vm); ok && owner == keepOwner {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "Deleting duplicate Virtual Machine instance %s (phase: %v)\n", vm.ObjectMeta.Name, vm.Status.Phase)
+		if err := DeleteJobVM(ctx, client, vm); err != nil && !k8serrors.IsNotFound(err) {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}
+	return keep
+}
+
+// DeleteJobVM deletes the specified job VM. Deleting the instance sends an
+// ACPI shutdown request to the guest, which gets killed if it does not shut
+// down within its termination grace period.
+//
+// Instances owned by a VirtualMachine must be deleted through their owner,
+// otherwise the controller would just recreate them.
+func DeleteJobVM(ctx context.Context, client kubevirt.KubevirtClient, vm *kubevirtapi.VirtualMachineInstance) error {
+	if owner, ok := OwnerVM(vm); ok {
+		return client.VirtualMachine(vm.ObjectMeta.Namespace).Delete(owner, &metav1.DeleteOptions{})
+	}
+	return client.VirtualMachineInstance(vm.ObjectMeta.Namespace).Delete(ctx, vm.ObjectMeta.Name, nil)
+}
+
+// AdoptableJobVM returns the VM of the job left over by a previous attempt at
+// preparing it, e.g. before the runner got restarted, or nil if there is
+// none. VMs that are being deleted cannot be adopted.
+func AdoptableJobVM(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) (*kubevirtapi.VirtualMachineInstance, error) {
+	list, err := client.VirtualMachineInstance(jctx.Namespace).List(ctx, Selector(jctx))
+	if err != nil {
+		return nil, err
+	}
+
+	var found []kubevirtapi.VirtualMachineInstance
+	for _, vm := range list.Items {
+		if vm.ObjectMeta.DeletionTimestamp == nil {
+			found = append(found, vm)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &found[0], nil
+	default:
+		return resolveDuplicateJobVMs(ctx, client, jctx, found), nil
+	}
+}
+
+var (
+	ErrWatchDone     = errors.New("watch done")
+	ErrJobVMNotFound = errors.New("Virtual Machine instance disappeared while the job was running!")
+)
+
+// WaitForDataVolume polls the specified DataVolume until it has been
+// populated, and reports its progress along the way. The DataVolume may not
+// exist yet, as it gets created by the KubeVirt controller.
+func WaitForDataVolume(ctx context.Context, client kubevirt.KubevirtClient, namespace, name string) error {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	var lastPhase cdiv1.DataVolumePhase
+	var lastProgress cdiv1.DataVolumeProgress
+	for {
+		dv, err := client.CdiClient().CdiV1beta1().DataVolumes(namespace).Get(ctx, name, metav1.GetOptions{})
+		switch {
+		case k8serrors.IsNotFound(err):
+		case err != nil:
+			return err
+		default:
+			phase, progress := dv.Status.Phase, dv.Status.Progress
+			if phase != lastPhase || progress != lastProgress {
+				fmt.Fprintf(os.Stderr, "DataVolume %s: %s %s\n", name, phase, progress)
+				lastPhase, lastProgress = phase, progress
+			}
+
+			switch phase {
+			case cdiv1.Succeeded, cdiv1.WaitForFirstConsumer:
+				return nil
+			case cdiv1.Failed:
+				return fmt.Errorf("populating DataVolume %s failed", name)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// VMICondition returns whether the specified condition of the VM is true.
+func VMICondition(vm *kubevirtapi.VirtualMachineInstance, condType kubevirtapi.VirtualMachineInstanceConditionType) bool {
+	for _, cond := range vm.Status.Conditions {
+		if cond.Type == condType && cond.Status == k8sapi.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// VMIUnschedulable returns the reason given by the scheduler when the
+// virt-launcher pod of the VM cannot be scheduled.
+func VMIUnschedulable(vm *kubevirtapi.VirtualMachineInstance) (string, bool) {
+	for _, cond := range vm.Status.Conditions {
+		if cond.Type == kubevirtapi.VirtualMachineInstanceConditionType(k8sapi.PodScheduled) &&
+			cond.Status == k8sapi.ConditionFalse &&
+			cond.Reason == k8sapi.PodReasonUnschedulable {
+			return cond.Message, true
+		}
+	}
+	return "", false
+}
+
+// VMIImagePullFailure returns the error of the registry when the images of
+// the virt-launcher pod of the VM, including its containerdisks, cannot be
+// pulled.
+func VMIImagePullFailure(vm *kubevirtapi.VirtualMachineInstance) (string, bool) {
+	for _, cond := range vm.Status.Conditions {
+		if cond.Type != kubevirtapi.VirtualMachineInstanceSynchronized || cond.Status != k8sapi.ConditionFalse {
+			continue
+		}
+		switch cond.Reason {
+		case "ErrImagePull", "ImagePullBackOff", "InvalidImageName":
+			return cond.Message, true
+		}
+	}
+	return "", false
+}
+
+// WatchJobVM calls fn with the changes to the job VM, until fn returns an
+// error or ErrWatchDone.
+//
+// Like an informer, it lists the VM before watching it, resumes watching from
+// the last seen resource version when the connection breaks, and lists the VM
+// again when that version has expired ("410 Gone"), reporting it as deleted if
+// it went away in the meantime. Bookmarks keep the resource version fresh
+// while the VM doesn't change, so that long waits can still resume watching.
 func WatchJobVM(
 	ctx context.Context,
 	client kubevirt.KubevirtClient,
@@ -200,56 +1447,134 @@ func WatchJobVM(
 	initial *kubevirtapi.VirtualMachineInstance,
 	fn func(watch.EventType, *kubevirtapi.VirtualMachineInstance) error,
 ) error {
-	opts := Selector(jctx)
-outer:
+	err := watchJobVM(ctx, client, jctx, initial, fn)
+	if err == ErrWatchDone {
+		err = nil
+	}
+	return err
+}
+
+func watchJobVM(
+	ctx context.Context,
+	client kubevirt.KubevirtClient,
+	jctx *JobContext,
+	known *kubevirtapi.VirtualMachineInstance,
+	fn func(watch.EventType, *kubevirtapi.VirtualMachineInstance) error,
+) error {
+	vmis := client.VirtualMachineInstance(jctx.Namespace)
+
+	back := backoff.NewExponentialBackOff()
+	back.MaxInterval = 5 * time.Second
+	back.MaxElapsedTime = 0
+
+	resourceVersion := ""
 	for {
-		if initial != nil {
-			opts.ResourceVersion = initial.ResourceVersion
+		if resourceVersion == "" {
+			list, err := vmis.List(ctx, Selector(jctx))
+			if err != nil {
+				return err
+			}
+			resourceVersion = list.ResourceVersion
+
+			var found *kubevirtapi.VirtualMachineInstance
+			for i := range list.Items {
+				if known == nil || list.Items[i].ObjectMeta.Name == known.ObjectMeta.Name {
+					found = &list.Items[i]
+					break
+				}
+			}
+			switch {
+			case found != nil:
+				known = found
+				if err := fn(watch.Modified, found); err != nil {
+					return err
+				}
+			case known != nil:
+				deleted := known
+				known = nil
+				if err := fn(watch.Deleted, deleted); err != nil {
+					return err
+				}
+			}
 		}
 
-		w, err := client.VirtualMachineInstance(jctx.Namespace).Watch(context.Background(), *opts)
-		if err != nil {
+		opts := *Selector(jctx)
+		opts.ResourceVersion = resourceVersion
+		opts.AllowWatchBookmarks = true
+
+		w, err := vmis.Watch(ctx, opts)
+		switch {
+		case k8serrors.IsResourceExpired(err), k8serrors.IsGone(err):
+			resourceVersion = ""
+			continue
+		case err != nil:
 			return err
 		}
-		defer w.Stop()
 
-		ch := w.ResultChan()
-		for {
-			select {
-			case event, ok := <-ch:
-				// Sometimes the connection breaks and the watch instance closes
-				// the channel; can't do anything other than retry.
-				if !ok || event.Type == "" {
-					continue outer
+		received := false
+		err = func() error {
+			defer w.Stop()
+
+			for {
+				var event watch.Event
+				select {
+				case event = <-w.ResultChan():
+				case <-ctx.Done():
+					return ctx.Err()
 				}
-				if event.Type == watch.Error {
-					status := event.Object.(*metav1.Status)
-					fmt.Fprintf(os.Stderr, "Error watching Virtual Machine instance, retrying. Reason: %s, Message: %s\n", status.Reason, status.Message)
+
+				switch event.Type {
+				case "":
+					// Sometimes the connection breaks and the watch instance
+					// closes the channel; resume from the last seen version.
+					return nil
+				case watch.Bookmark:
+					if val, ok := event.Object.(*kubevirtapi.VirtualMachineInstance); ok {
+						resourceVersion = val.ResourceVersion
+					}
+				case watch.Error:
+					err := k8serrors.FromObject(event.Object)
+					if k8serrors.IsResourceExpired(err) || k8serrors.IsGone(err) {
+						fmt.Fprintf(Debug, "watch expired, listing again: %v\n", err)
+						resourceVersion = ""
+						return nil
+					}
+					fmt.Fprintf(os.Stderr, "Error watching Virtual Machine instance, retrying: %v\n", err)
 					// Give a chance to the watch function to respond
 					if err := fn(event.Type, nil); err != nil {
-						if err == ErrWatchDone {
-							err = nil
-						}
 						return err
 					}
-					initial.ResourceVersion = "0"
-					continue outer
-				}
-
-				val, ok := event.Object.(*kubevirtapi.VirtualMachineInstance)
-				if !ok {
-					panic(fmt.Sprintf("unexpected object type %T in event type %s", event.Object, event.Type))
-				}
-				if err := fn(event.Type, val); err != nil {
-					if err == ErrWatchDone {
-						err = nil
+					resourceVersion = ""
+					return nil
+				default:
+					val, ok := event.Object.(*kubevirtapi.VirtualMachineInstance)
+					if !ok {
+						panic(fmt.Sprintf("unexpected object type %T in event type %s", event.Object, event.Type))
+					}
+					received = true
+					resourceVersion = val.ResourceVersion
+					if event.Type == watch.Deleted {
+						known = nil
+					} else {
+						known = val
+					}
+					if err := fn(event.Type, val); err != nil {
+						return err
 					}
-					return err
 				}
-				initial = val
-			case <-ctx.Done():
-				return ctx.Err()
 			}
+		}()
+		if err != nil {
+			return err
+		}
+
+		if received {
+			back.Reset()
+		}
+		select {
+		case <-time.After(back.NextBackOff()):
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 }
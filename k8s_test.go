@@ -0,0 +1,45 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestIsTransientCreateError(t *testing.T) {
+	vmis := schema.GroupResource{Group: "kubevirt.io", Resource: "virtualmachineinstances"}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"quota exceeded", k8serrors.NewForbidden(vmis, "job-1", errors.New("exceeded quota: compute, requested: requests.cpu=2, used: requests.cpu=8, limited: requests.cpu=8")), true},
+		{"forbidden", k8serrors.NewForbidden(vmis, "job-1", errors.New("User \"runner\" cannot create resource")), false},
+		{"conflict", k8serrors.NewConflict(vmis, "job-1", errors.New("the object has been modified")), true},
+		{"webhook unavailable", k8serrors.NewInternalError(errors.New("failed calling webhook \"virtualmachineinstances-create-validator.kubevirt.io\"")), true},
+		{"server timeout", k8serrors.NewServerTimeout(vmis, "create", 1), true},
+		{"timeout", k8serrors.NewTimeoutError("request timed out", 1), true},
+		{"too many requests", k8serrors.NewTooManyRequests("slow down", 1), true},
+		{"service unavailable", k8serrors.NewServiceUnavailable("apiserver is shutting down"), true},
+		{"invalid", k8serrors.NewBadRequest("spec.domain.devices: invalid"), false},
+		{"already exists", k8serrors.NewAlreadyExists(vmis, "job-1"), false},
+		{"wrapped", fmt.Errorf("creating job VM: %w", k8serrors.NewServiceUnavailable("down")), true},
+		{"not an API error", errors.New("connection refused"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransientCreateError(tt.err); got != tt.want {
+				t.Errorf("isTransientCreateError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	k8sapi "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// ResourceLimitError reports that the resources of the job VM can never be
+// allowed in the namespace.
+type ResourceLimitError struct {
+	Violations []string
+}
+
+func (e *ResourceLimitError) Error() string {
+	return "the resources of the Virtual Machine instance exceed what the namespace allows: " + strings.Join(e.Violations, "; ")
+}
+
+// quotaResources maps the resources of ResourceQuotas to the requests or
+// limits of the VM they account for.
+var quotaResources = map[k8sapi.ResourceName]struct {
+	limit bool
+	name  k8sapi.ResourceName
+}{
+	k8sapi.ResourceCPU:                      {false, k8sapi.ResourceCPU},
+	k8sapi.ResourceMemory:                   {false, k8sapi.ResourceMemory},
+	k8sapi.ResourceEphemeralStorage:         {false, k8sapi.ResourceEphemeralStorage},
+	k8sapi.ResourceRequestsCPU:              {false, k8sapi.ResourceCPU},
+	k8sapi.ResourceRequestsMemory:           {false, k8sapi.ResourceMemory},
+	k8sapi.ResourceRequestsEphemeralStorage: {false, k8sapi.ResourceEphemeralStorage},
+	k8sapi.ResourceLimitsCPU:                {true, k8sapi.ResourceCPU},
+	k8sapi.ResourceLimitsMemory:             {true, k8sapi.ResourceMemory},
+	k8sapi.ResourceLimitsEphemeralStorage:   {true, k8sapi.ResourceEphemeralStorage},
+}
+
+// ValidateJobVMResources checks the resources of the job VM against the
+// LimitRanges and ResourceQuotas of the namespace, so that VMs that can never
+// be admitted are reported with a readable message rather than an admission
+// error. Quotas are checked against their hard limits only: the resources
+// currently in use are freed as other jobs finish.
+//
+// The virt-launcher pod of the VM requests a bit more than the VM itself, so
+// VMs close to the limits may still get rejected.
+func ValidateJobVMResources(ctx context.Context, client kubevirt.KubevirtClient, namespace string, resources kubevirtapi.ResourceRequirements) error {
+	// Requests default to the limits, like for containers.
+	requests := k8sapi.ResourceList{}
+	for name, quantity := range resources.Limits {
+		requests[name] = quantity
+	}
+	for name, quantity := range resources.Requests {
+		requests[name] = quantity
+	}
+	requested := func(limit bool) (string, k8sapi.ResourceList) {
+		if limit {
+			return "limit", resources.Limits
+		}
+		return "request", requests
+	}
+
+	var violations []string
+
+	// Listing LimitRanges and ResourceQuotas is a nicety, which the
+	// runner may not be allowed to do.
+	ranges, err := client.CoreV1().LimitRanges(namespace).List(ctx, metav1.ListOptions{})
+	switch {
+	case k8serrors.IsForbidden(err):
+		fmt.Fprintln(Debug, err)
+	case err != nil:
+		return err
+	default:
+		for _, limitRange := range ranges.Items {
+			for _, item := range limitRange.Spec.Limits {
+				if item.Type != k8sapi.LimitTypeContainer && item.Type != k8sapi.LimitTypePod {
+					continue
+				}
+				for _, limit := range []bool{false, true} {
+					kind, list := requested(limit)
+					for name, quantity := range list {
+						if max, ok := item.Max[name]; ok && quantity.Cmp(max) > 0 {
+							violations = append(violations, fmt.Sprintf("%s %s of %s exceeds the maximum of %s set by LimitRange %s", name, kind, quantity.String(), max.String(), limitRange.ObjectMeta.Name))
+						}
+						if min, ok := item.Min[name]; ok && quantity.Cmp(min) < 0 {
+							violations = append(violations, fmt.Sprintf("%s %s of %s is below the minimum of %s set by LimitRange %s", name, kind, quantity.String(), min.String(), limitRange.ObjectMeta.Name))
+						}
+					}
+				}
+			}
+		}
+	}
+
+	quotas, err := client.CoreV1().ResourceQuotas(namespace).List(ctx, metav1.ListOptions{})
+	switch {
+	case k8serrors.IsForbidden(err):
+		fmt.Fprintln(Debug, err)
+	case err != nil:
+		return err
+	default:
+		for _, quota := range quotas.Items {
+			for resource, hard := range quota.Spec.Hard {
+				accounted, ok := quotaResources[resource]
+				if !ok {
+					continue
+				}
+				kind, list := requested(accounted.limit)
+				if quantity, ok := list[accounted.name]; ok && quantity.Cmp(hard) > 0 {
+					violations = append(violations, fmt.Sprintf("%s %s of %s exceeds the %s of %s allowed in the namespace by ResourceQuota %s", accounted.name, kind, quantity.String(), resource, hard.String(), quota.ObjectMeta.Name))
+				}
+			}
+		}
+	}
+
+	if len(violations) > 0 {
+		sort.Strings(violations)
+		return &ResourceLimitError{Violations: violations}
+	}
+	return nil
+}
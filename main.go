@@ -13,9 +13,13 @@ import (
 	"hash"
 	"io"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/alecthomas/kong"
+	k8sapi "k8s.io/api/core/v1"
 )
 
 type JobContext struct {
@@ -26,6 +30,64 @@ type JobContext struct {
 	ImagePullSecret string
 	Namespace       string
 	MachineType     string
+	Arch            string
+	RootDiskBus     string
+	RootPVC         string
+	RootDataSource  string
+	RootSnapshot    string
+	RootDiskSize    string
+
+	StorageClassName string
+	VolumeMode       string
+	AccessModes      []string
+
+	ContainerDisks  []string
+	BootOrder       []string
+	ScratchDiskSize string
+	HotplugVolumes  []string
+	ExposePorts     []string
+	CacheClaim      string
+	BuildsClaim     string
+	ConfigMaps      []string
+	Secrets         []string
+	DownwardAPI     bool
+	ServiceAccount  string
+
+	// Cluster is the tag of the clusters the job asked to run on, if any.
+	Cluster string
+
+	Instancetype     string
+	InstancetypeKind string
+	Preference       string
+	PreferenceKind   string
+	NodeSelector     map[string]string
+	GPUs             map[string]int
+	Networks         []NetworkAttachment
+	Istio            bool
+	Affinity         *k8sapi.Affinity
+
+	PriorityClassName string
+	SchedulerName     string
+	EvictionStrategy  string
+	Hostname          string
+	Subdomain         string
+	DNSPolicy         string
+	DNSConfig         *k8sapi.PodDNSConfig
+
+	TerminationGracePeriod time.Duration
+
+	TopologySpreadConstraints []k8sapi.TopologySpreadConstraint
+
+	CloudInitType           string
+	CloudInitUserData       string
+	CloudInitUserDataSecret string
+	SysprepConfigMap        string
+	SysprepSecret           string
+	VirtioDriversImage      string
+
+	VMITemplate  string
+	VMIPatch     string
+	VMIPatchType string
 
 	CPURequest              string
 	CPULimit                string
@@ -33,7 +95,28 @@ type JobContext struct {
 	MemoryLimit             string
 	EphemeralStorageRequest string
 	EphemeralStorageLimit   string
+	HugepagesPageSize       string
+	GuestMemory             string
+	CPUModel                string
+	CPUFeatures             []string
+	CPUSockets              uint32
+	CPUCores                uint32
+	CPUThreads              uint32
+	DedicatedCPUPlacement   bool
+	NUMAPassthrough         bool
+	Firmware                string
+	SecureBoot              bool
+	TPM                     bool
+	Hyperv                  bool
+	RNG                     bool
+	KVMHidden               bool
+	HypervVendorID          string
 	Timezone                string
+	ClockOffset             string
+	Timers                  []string
+	IOThreadsPolicy         string
+	DedicatedIOThreads      []string
+	BlockMultiQueue         bool
 
 	ProjectID    string
 	JobID        string
@@ -42,6 +125,23 @@ type JobContext struct {
 	JobSha       string
 	JobBeforeSha string
 	JobURL       string
+	PipelineURL  string
+
+	Labels      map[string]string
+	Annotations map[string]string
+
+	// Job is the job payload, if gitlab-runner provided it.
+	Job *JobResponse
+
+	DockerAuthConfig string
+	Registry         string
+	RegistryUser     string
+	RegistryPassword string
+
+	// JobTimeout is the timeout of the job, if known, and TimeoutMargin the
+	// grace period granted on top of it to the stages of the driver.
+	JobTimeout    time.Duration
+	TimeoutMargin time.Duration
 }
 
 var cli struct {
@@ -54,14 +154,88 @@ var cli struct {
 	JobSha       string `name:"job-sha" env:"CUSTOM_ENV_CI_COMMIT_SHA"`
 	JobBeforeSha string `name:"job-before-sha" env:"CUSTOM_ENV_CI_COMMIT_BEFORE_SHA"`
 	JobURL       string `name:"job-url" env:"CUSTOM_ENV_CI_JOB_URL"`
+	PipelineURL  string `name:"pipeline-url" env:"CUSTOM_ENV_CI_PIPELINE_URL"`
 	JobImage     string `name:"image" env:"CUSTOM_ENV_CI_JOB_IMAGE"`
 	Namespace    string `name:"namespace" env:"KUBEVIRT_NAMESPACE" default:"gitlab-runner"`
 	Debug        bool
+	Sections     bool `name:"sections" default:"true" negatable:"" help:"Wrap the output of the driver in collapsible sections of the job log"`
+
+	DockerAuthConfig string `name:"docker-auth-config" env:"CUSTOM_ENV_DOCKER_AUTH_CONFIG"`
+	Registry         string `name:"registry" env:"CUSTOM_ENV_CI_REGISTRY"`
+	RegistryUser     string `name:"registry-user" env:"CUSTOM_ENV_CI_REGISTRY_USER"`
+	RegistryPassword string `name:"registry-password" env:"CUSTOM_ENV_CI_REGISTRY_PASSWORD"`
+
+	JobTimeout    int64         `name:"job-timeout" env:"CUSTOM_ENV_CI_JOB_TIMEOUT" help:"Timeout of the job, in seconds"`
+	TimeoutMargin time.Duration `name:"timeout-margin" env:"KUBEVIRT_TIMEOUT_MARGIN" default:"10m" help:"Grace margin added to the job timeout when deriving the timeouts of stages"`
+
+	JobResponseFile string `name:"job-response-file" env:"JOB_RESPONSE_FILE"`
+
+	KubeQPS     float32       `name:"kube-qps" env:"KUBEVIRT_KUBE_QPS" default:"5" help:"Maximum rate of requests to the Kubernetes API server, per second"`
+	KubeBurst   int           `name:"kube-burst" env:"KUBEVIRT_KUBE_BURST" default:"10" help:"Maximum burst of requests to the Kubernetes API server"`
+	KubeTimeout time.Duration `name:"kube-timeout" env:"KUBEVIRT_KUBE_TIMEOUT" help:"Timeout of requests to the Kubernetes API server; interrupted watches get resumed"`
+	KubeRetries int           `name:"kube-retries" env:"KUBEVIRT_KUBE_RETRIES" default:"5" help:"How many times to retry requests to the Kubernetes API server that fail because it is overloaded or unavailable"`
+
+	KubeContext string `name:"kube-context" env:"KUBEVIRT_KUBE_CONTEXT" help:"Kubeconfig context of the cluster to run job VMs on; set by the config stage when dispatching to several clusters"`
+	Cluster     string `name:"job-cluster" env:"CUSTOM_ENV_KUBEVIRT_CLUSTER" help:"Tag of the clusters to run the job VM on"`
+
+	MetricsPushgateway string `name:"metrics-pushgateway" env:"KUBEVIRT_METRICS_PUSHGATEWAY" help:"URL of a Prometheus Pushgateway to push the metrics of the driver to"`
+	MetricsTextfile    string `name:"metrics-textfile" env:"KUBEVIRT_METRICS_TEXTFILE" type:"path" help:"File to write the metrics of the driver to, for the textfile collector of the node exporter"`
+	MetricsState       string `name:"metrics-state" env:"KUBEVIRT_METRICS_STATE" type:"path" help:"File accumulating the metrics of the driver across stages"`
+
+	OTLPEndpoint string            `name:"otlp-endpoint" env:"KUBEVIRT_OTLP_ENDPOINT" help:"Base URL of an OTLP/HTTP endpoint to export the traces of jobs to; defaults to $OTEL_EXPORTER_OTLP_ENDPOINT"`
+	OTLPHeaders  map[string]string `name:"otlp-headers" env:"KUBEVIRT_OTLP_HEADERS" mapsep:"," help:"Additional headers of the requests to the OTLP endpoint, e.g. for authentication"`
+
+	Events bool `name:"events" env:"KUBEVIRT_EVENTS" default:"true" negatable:"" help:"Post Kubernetes events on job VMs at the milestones of jobs"`
+
+	Arch                    string            `name:"arch" env:"CUSTOM_ENV_KUBEVIRT_ARCH"`
+	MachineType             string            `name:"machine-type" env:"CUSTOM_ENV_KUBEVIRT_MACHINE_TYPE"`
+	CPURequest              string            `name:"cpu-request" env:"CUSTOM_ENV_KUBEVIRT_CPU_REQUEST"`
+	CPULimit                string            `name:"cpu-limit" env:"CUSTOM_ENV_KUBEVIRT_CPU_LIMIT"`
+	MemoryRequest           string            `name:"memory-request" env:"CUSTOM_ENV_KUBEVIRT_MEMORY_REQUEST"`
+	MemoryLimit             string            `name:"memory-limit" env:"CUSTOM_ENV_KUBEVIRT_MEMORY_LIMIT"`
+	EphemeralStorageRequest string            `name:"ephemeral-storage-request" env:"CUSTOM_ENV_KUBEVIRT_EPHEMERAL_STORAGE_REQUEST"`
+	EphemeralStorageLimit   string            `name:"ephemeral-storage-limit" env:"CUSTOM_ENV_KUBEVIRT_EPHEMERAL_STORAGE_LIMIT"`
+	Instancetype            string            `name:"instancetype" env:"CUSTOM_ENV_KUBEVIRT_INSTANCETYPE"`
+	InstancetypeKind        string            `name:"instancetype-kind" env:"CUSTOM_ENV_KUBEVIRT_INSTANCETYPE_KIND"`
+	Preference              string            `name:"preference" env:"CUSTOM_ENV_KUBEVIRT_PREFERENCE"`
+	PreferenceKind          string            `name:"preference-kind" env:"CUSTOM_ENV_KUBEVIRT_PREFERENCE_KIND"`
+	RootDiskBus             string            `name:"root-disk-bus" env:"CUSTOM_ENV_KUBEVIRT_ROOT_DISK_BUS"`
+	RootPVC                 string            `name:"root-pvc" env:"CUSTOM_ENV_KUBEVIRT_ROOT_PVC"`
+	RootDataSource          string            `name:"root-datasource" env:"CUSTOM_ENV_KUBEVIRT_ROOT_DATASOURCE"`
+	RootSnapshot            string            `name:"root-snapshot" env:"CUSTOM_ENV_KUBEVIRT_ROOT_SNAPSHOT"`
+	RootDiskSize            string            `name:"disk-size" env:"CUSTOM_ENV_KUBEVIRT_DISK_SIZE"`
+	ContainerDisks          []string          `name:"containerdisks" env:"CUSTOM_ENV_KUBEVIRT_CONTAINERDISKS" sep:","`
+	ScratchDiskSize         string            `name:"scratch-disk-size" env:"CUSTOM_ENV_KUBEVIRT_SCRATCH_DISK_SIZE"`
+	HotplugVolumes          []string          `name:"hotplug-volumes" env:"CUSTOM_ENV_KUBEVIRT_HOTPLUG_VOLUMES" sep:","`
+	ImagePullPolicy         string            `name:"image-pull-policy" env:"CUSTOM_ENV_KUBEVIRT_IMAGE_PULL_POLICY"`
+	ExposePorts             []string          `name:"expose-ports" env:"CUSTOM_ENV_KUBEVIRT_EXPOSE_PORTS" sep:","`
+	BootOrder               []string          `name:"boot-order" env:"CUSTOM_ENV_KUBEVIRT_BOOT_ORDER" sep:","`
+	NodeSelector            map[string]string `name:"node-selector" env:"CUSTOM_ENV_KUBEVIRT_NODE_SELECTOR" mapsep:","`
+	GPUs                    map[string]int    `name:"gpus" env:"CUSTOM_ENV_KUBEVIRT_GPUS" mapsep:","`
+	HugepagesPageSize       string            `name:"hugepages-page-size" env:"CUSTOM_ENV_KUBEVIRT_HUGEPAGES_PAGE_SIZE"`
+	CPUModel                string            `name:"cpu-model" env:"CUSTOM_ENV_KUBEVIRT_CPU_MODEL"`
+	CPUFeatures             []string          `name:"cpu-features" env:"CUSTOM_ENV_KUBEVIRT_CPU_FEATURES" sep:","`
+	CPUSockets              uint32            `name:"cpu-sockets" env:"CUSTOM_ENV_KUBEVIRT_CPU_SOCKETS"`
+	CPUCores                uint32            `name:"cpu-cores" env:"CUSTOM_ENV_KUBEVIRT_CPU_CORES"`
+	CPUThreads              uint32            `name:"cpu-threads" env:"CUSTOM_ENV_KUBEVIRT_CPU_THREADS"`
+	Hyperv                  bool              `name:"hyperv" env:"CUSTOM_ENV_KUBEVIRT_HYPERV"`
+	ServiceAccount          string            `name:"service-account" env:"CUSTOM_ENV_KUBEVIRT_SERVICE_ACCOUNT"`
+	Hostname                string            `name:"hostname" env:"CUSTOM_ENV_KUBEVIRT_HOSTNAME"`
+	PriorityClassName       string            `name:"priority-class" env:"CUSTOM_ENV_KUBEVIRT_PRIORITY_CLASS_NAME"`
+	CloudInitUserData       string            `name:"cloud-init-user-data" env:"CUSTOM_ENV_KUBEVIRT_CLOUD_INIT_USER_DATA"`
+	Labels                  map[string]string `name:"labels" env:"CUSTOM_ENV_KUBEVIRT_LABELS" mapsep:","`
+	Annotations             map[string]string `name:"annotations" env:"CUSTOM_ENV_KUBEVIRT_ANNOTATIONS" mapsep:","`
+	VMIPatch                string            `name:"vmi-patch" env:"CUSTOM_ENV_KUBEVIRT_VMI_PATCH"`
+	VMIPatchType            string            `name:"vmi-patch-type" env:"CUSTOM_ENV_KUBEVIRT_VMI_PATCH_TYPE" default:"strategic" enum:"strategic,merge"`
 
 	Config  ConfigCmd  `cmd`
 	Prepare PrepareCmd `cmd`
 	Run     RunCmd     `cmd`
 	Cleanup CleanupCmd `cmd`
+
+	StepsProxy StepsProxyCmd `cmd name:"steps-proxy" help:"Proxy a gRPC connection to the step-runner of the job VM over stdio"`
+	Gc         GcCmd         `cmd name:"gc" help:"Delete the VMs and resources left over by jobs that were never cleaned up"`
+	Doctor     DoctorCmd     `cmd name:"doctor" help:"Check that the driver can run jobs in this environment"`
 }
 
 var Debug io.Writer = io.Discard
@@ -76,16 +250,41 @@ func main() {
 
 	jctx := contextFromEnv()
 
+	if cli.JobResponseFile != "" {
+		job, err := LoadJobResponse(cli.JobResponseFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+			systemFailureExit()
+		}
+		jctx.Job = job
+		if job.Image.Name != "" {
+			jctx.Image = job.Image.Name
+		}
+	}
+
 	ctx.Bind(jctx)
 	ctx.BindToProvider(KubeClient)
+	// gitlab-runner terminates the executor when the job gets cancelled;
+	// cancel the context so that the ongoing stage can wind down.
+	sigctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
 	ctx.BindToProvider(func() (context.Context, error) {
-		return context.Background(), nil
+		return sigctx, nil
 	})
 
+	switch cmd := ctx.Command(); cmd {
+	case "prepare", "cleanup":
+		metrics.StartStage(sigctx, cmd)
+		tracer.StartStage(sigctx, jctx, cmd)
+	}
+
 	if err := ctx.Run(jctx); err != nil {
 		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
 		systemFailureExit()
 	}
+	metrics.Finish("success")
+	tracer.Finish("success")
 }
 
 func contextFromEnv() *JobContext {
@@ -94,6 +293,48 @@ func contextFromEnv() *JobContext {
 	jctx.ID = digest(sha1.New, cli.RunnerID, cli.ProjectID, cli.ConcurrentID, cli.JobID)
 	jctx.Image = cli.JobImage
 	jctx.Namespace = cli.Namespace
+	jctx.Cluster = cli.Cluster
+
+	jctx.Arch = cli.Arch
+	jctx.MachineType = cli.MachineType
+	jctx.CPURequest = cli.CPURequest
+	jctx.CPULimit = cli.CPULimit
+	jctx.MemoryRequest = cli.MemoryRequest
+	jctx.MemoryLimit = cli.MemoryLimit
+	jctx.EphemeralStorageRequest = cli.EphemeralStorageRequest
+	jctx.EphemeralStorageLimit = cli.EphemeralStorageLimit
+	jctx.Instancetype = cli.Instancetype
+	jctx.InstancetypeKind = cli.InstancetypeKind
+	jctx.Preference = cli.Preference
+	jctx.PreferenceKind = cli.PreferenceKind
+	jctx.RootDiskBus = cli.RootDiskBus
+	jctx.RootPVC = cli.RootPVC
+	jctx.RootDataSource = cli.RootDataSource
+	jctx.RootSnapshot = cli.RootSnapshot
+	jctx.RootDiskSize = cli.RootDiskSize
+	jctx.ContainerDisks = cli.ContainerDisks
+	jctx.ScratchDiskSize = cli.ScratchDiskSize
+	jctx.HotplugVolumes = cli.HotplugVolumes
+	jctx.ImagePullPolicy = cli.ImagePullPolicy
+	jctx.ExposePorts = cli.ExposePorts
+	jctx.BootOrder = cli.BootOrder
+	jctx.NodeSelector = cli.NodeSelector
+	jctx.GPUs = cli.GPUs
+	jctx.HugepagesPageSize = cli.HugepagesPageSize
+	jctx.CPUModel = cli.CPUModel
+	jctx.CPUFeatures = cli.CPUFeatures
+	jctx.CPUSockets = cli.CPUSockets
+	jctx.CPUCores = cli.CPUCores
+	jctx.CPUThreads = cli.CPUThreads
+	jctx.Hyperv = cli.Hyperv
+	jctx.ServiceAccount = cli.ServiceAccount
+	jctx.Hostname = cli.Hostname
+	jctx.PriorityClassName = cli.PriorityClassName
+	jctx.CloudInitUserData = cli.CloudInitUserData
+	jctx.Labels = cli.Labels
+	jctx.Annotations = cli.Annotations
+	jctx.VMIPatch = cli.VMIPatch
+	jctx.VMIPatchType = cli.VMIPatchType
 
 	jctx.ProjectID = cli.ProjectID
 	jctx.JobID = cli.JobID
@@ -102,9 +343,30 @@ func contextFromEnv() *JobContext {
 	jctx.JobSha = cli.JobSha
 	jctx.JobBeforeSha = cli.JobBeforeSha
 	jctx.JobURL = cli.JobURL
+	jctx.PipelineURL = cli.PipelineURL
+	jctx.DockerAuthConfig = cli.DockerAuthConfig
+	jctx.Registry = cli.Registry
+	jctx.RegistryUser = cli.RegistryUser
+	jctx.RegistryPassword = cli.RegistryPassword
+	jctx.JobTimeout = time.Duration(cli.JobTimeout) * time.Second
+	jctx.TimeoutMargin = cli.TimeoutMargin
 	return &jctx
 }
 
+// stageTimeout returns the timeout of a stage. Unless set explicitly, it
+// derives from the job timeout plus a grace margin, or defaults to an hour
+// if the job timeout isn't known.
+func stageTimeout(timeout time.Duration, jctx *JobContext) time.Duration {
+	switch {
+	case timeout != 0:
+		return timeout
+	case jctx.JobTimeout != 0:
+		return jctx.JobTimeout + jctx.TimeoutMargin
+	default:
+		return time.Hour
+	}
+}
+
 func digest(hashfunc func() hash.Hash, v ...interface{}) string {
 	digest := hashfunc()
 	binary.Write(digest, binary.BigEndian, len(v))
@@ -136,9 +398,13 @@ func envExit(status int, env string) {
 }
 
 func systemFailureExit() {
+	metrics.Finish("system_failure")
+	tracer.Finish("system_failure")
 	envExit(2, "SYSTEM_FAILURE_EXIT_CODE")
 }
 
 func buildFailureExit() {
+	metrics.Finish("build_failure")
+	tracer.Finish("build_failure")
 	envExit(1, "BUILD_FAILURE_EXIT_CODE")
 }
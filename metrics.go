@@ -0,0 +1,312 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+const metricsPrefix = "gitlab_runner_kubevirt_"
+
+var metricDefs = map[string]struct {
+	Type string
+	Help string
+}{
+	metricsPrefix + "stage_duration_seconds":        {"summary", "Duration of the stages of jobs, by result."},
+	metricsPrefix + "vm_schedule_duration_seconds":  {"summary", "Time it took job VMs to get scheduled on a node."},
+	metricsPrefix + "vm_boot_duration_seconds":      {"summary", "Time it took job VMs to boot once scheduled."},
+	metricsPrefix + "vm_ssh_ready_duration_seconds": {"summary", "Time it took job VMs to become reachable via ssh once booted."},
+	metricsPrefix + "failures_total":                {"counter", "Failed stages of jobs, by type of failure."},
+	metricsPrefix + "active_vms":                    {"gauge", "Job VMs in the namespace, as of the last prepare or cleanup stage."},
+	metricsPrefix + "last_stage_timestamp_seconds":  {"gauge", "Time at which the last stage of a job ended."},
+}
+
+// Metrics collects the metrics of the stage being run. Stages are
+// short-lived processes that cannot be scraped, so the metrics get merged
+// into a state file shared by all stages, and are then written to a
+// textfile for the node exporter, or pushed to a Pushgateway.
+type Metrics struct {
+	ctx   context.Context
+	stage string
+	start time.Time
+
+	updates []metricSeries
+	done    bool
+}
+
+type metricSeries struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+
+	// add is whether Value is added to the merged value of the series
+	// rather than replacing it.
+	add bool
+}
+
+func (s *metricSeries) key() string {
+	keys := make([]string, 0, len(s.Labels))
+	for k := range s.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(s.Name)
+	for _, k := range keys {
+		fmt.Fprintf(&b, ",%s=%q", k, s.Labels[k])
+	}
+	return b.String()
+}
+
+var metrics Metrics
+
+// Enabled is whether metrics get reported at all.
+func (m *Metrics) Enabled() bool {
+	return cli.MetricsPushgateway != "" || cli.MetricsTextfile != ""
+}
+
+// StartStage records that the specified stage started. A stage that gets
+// cancelled through ctx ends as such.
+func (m *Metrics) StartStage(ctx context.Context, stage string) {
+	m.ctx, m.stage, m.start = ctx, stage, time.Now()
+}
+
+// Observe records a duration in the specified summary.
+func (m *Metrics) Observe(name string, d time.Duration, labels ...string) {
+	lbls := metricLabels(labels)
+	m.updates = append(m.updates,
+		metricSeries{Name: name + "_sum", Labels: lbls, Value: d.Seconds(), add: true},
+		metricSeries{Name: name + "_count", Labels: lbls, Value: 1, add: true})
+}
+
+// Inc increments the specified counter.
+func (m *Metrics) Inc(name string, labels ...string) {
+	m.updates = append(m.updates, metricSeries{Name: name, Labels: metricLabels(labels), Value: 1, add: true})
+}
+
+// Set sets the specified gauge.
+func (m *Metrics) Set(name string, value float64, labels ...string) {
+	m.updates = append(m.updates, metricSeries{Name: name, Labels: metricLabels(labels), Value: value})
+}
+
+// RecordActiveVMs records the number of job VMs in the namespace.
+func (m *Metrics) RecordActiveVMs(ctx context.Context, client kubevirt.KubevirtClient, namespace string) {
+	if !m.Enabled() {
+		return
+	}
+	count, err := countJobVMs(ctx, client, namespace)
+	if err != nil {
+		fmt.Fprintf(Debug, "counting job VMs: %v\n", err)
+		return
+	}
+	m.Set(metricsPrefix+"active_vms", float64(count), "namespace", namespace)
+}
+
+// Finish records the end of the stage with the specified result (success,
+// build_failure, or system_failure), and reports the metrics. Failing to
+// report them does not fail the stage.
+func (m *Metrics) Finish(result string) {
+	if m.done || m.stage == "" || !m.Enabled() {
+		return
+	}
+	m.done = true
+
+	if m.ctx != nil && m.ctx.Err() != nil {
+		result = "cancelled"
+	}
+	m.Observe(metricsPrefix+"stage_duration_seconds", time.Since(m.start), "stage", m.stage, "result", result)
+	if result != "success" {
+		m.Inc(metricsPrefix+"failures_total", "stage", m.stage, "type", result)
+	}
+	m.Set(metricsPrefix+"last_stage_timestamp_seconds", float64(time.Now().Unix()), "stage", m.stage)
+
+	if err := m.report(); err != nil {
+		fmt.Fprintf(os.Stderr, "reporting metrics: %v\n", err)
+	}
+}
+
+func (m *Metrics) report() error {
+	path := cli.MetricsState
+	if path == "" {
+		path = filepath.Join(os.TempDir(), "gitlab-runner-kubevirt-metrics.json")
+	}
+
+	// Merging is best-effort: stages of concurrent jobs ending at the same
+	// time may lose each other's updates.
+	var merged []metricSeries
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &merged); err != nil {
+			fmt.Fprintf(os.Stderr, "discarding corrupt metrics state %s: %v\n", path, err)
+			merged = nil
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	merged = mergeMetrics(merged, m.updates)
+
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+
+	exposition := formatMetrics(merged)
+	if cli.MetricsTextfile != "" {
+		if err := writeFileAtomic(cli.MetricsTextfile, exposition); err != nil {
+			return err
+		}
+	}
+	if cli.MetricsPushgateway != "" {
+		if err := pushMetrics(cli.MetricsPushgateway, exposition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeMetrics applies the updates to the series: counters and summaries
+// are added to, and gauges replaced.
+func mergeMetrics(series, updates []metricSeries) []metricSeries {
+	index := make(map[string]int, len(series))
+	for i := range series {
+		index[series[i].key()] = i
+	}
+	for _, update := range updates {
+		i, ok := index[update.key()]
+		switch {
+		case !ok:
+			index[update.key()] = len(series)
+			series = append(series, update)
+		case update.add:
+			series[i].Value += update.Value
+		default:
+			series[i].Value = update.Value
+		}
+	}
+	return series
+}
+
+// formatMetrics renders the series in the Prometheus text exposition format.
+func formatMetrics(series []metricSeries) []byte {
+	sorted := append([]metricSeries(nil), series...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].key() < sorted[j].key()
+	})
+
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+	var b bytes.Buffer
+	family := ""
+	for _, s := range sorted {
+		name := strings.TrimSuffix(strings.TrimSuffix(s.Name, "_sum"), "_count")
+		if _, ok := metricDefs[name]; !ok {
+			name = s.Name
+		}
+		if name != family {
+			family = name
+			if def, ok := metricDefs[name]; ok {
+				fmt.Fprintf(&b, "# HELP %s %s\n", name, def.Help)
+				fmt.Fprintf(&b, "# TYPE %s %s\n", name, def.Type)
+			}
+		}
+
+		keys := make([]string, 0, len(s.Labels))
+		for k := range s.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		b.WriteString(s.Name)
+		for i, k := range keys {
+			sep := ","
+			if i == 0 {
+				sep = "{"
+			}
+			fmt.Fprintf(&b, `%s%s="%s"`, sep, k, escape.Replace(s.Labels[k]))
+		}
+		if len(keys) > 0 {
+			b.WriteString("}")
+		}
+		fmt.Fprintf(&b, " %v\n", s.Value)
+	}
+	return b.Bytes()
+}
+
+// pushMetrics replaces the metrics of the runner in the Pushgateway.
+func pushMetrics(gateway string, exposition []byte) error {
+	instance := cli.RunnerID
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	u := strings.TrimSuffix(gateway, "/") + "/metrics/job/gitlab-runner-kubevirt/instance/" + url.PathEscape(instance)
+
+	req, err := http.NewRequest(http.MethodPut, u, bytes.NewReader(exposition))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("pushing metrics to %s: %s", gateway, resp.Status)
+	}
+	return nil
+}
+
+// writeFileAtomic writes the file through a temporary file in the same
+// directory, so that readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func metricLabels(kv []string) map[string]string {
+	if len(kv) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		labels[kv[i]] = kv[i+1]
+	}
+	return labels
+}
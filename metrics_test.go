@@ -0,0 +1,106 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeMetrics(t *testing.T) {
+	success := map[string]string{"stage": "prepare", "result": "success"}
+	failure := map[string]string{"stage": "prepare", "result": "system_failure"}
+
+	tests := []struct {
+		name            string
+		series, updates []metricSeries
+		want            []metricSeries
+	}{
+		{
+			name:    "new series",
+			updates: []metricSeries{{Name: "vms", Value: 3}},
+			want:    []metricSeries{{Name: "vms", Value: 3}},
+		},
+		{
+			name:    "gauges are replaced",
+			series:  []metricSeries{{Name: "vms", Value: 3}},
+			updates: []metricSeries{{Name: "vms", Value: 1}},
+			want:    []metricSeries{{Name: "vms", Value: 1}},
+		},
+		{
+			name:    "counters are added to",
+			series:  []metricSeries{{Name: "failures_total", Value: 2}},
+			updates: []metricSeries{{Name: "failures_total", Value: 1, add: true}},
+			want:    []metricSeries{{Name: "failures_total", Value: 3}},
+		},
+		{
+			name:    "repeated updates",
+			updates: []metricSeries{{Name: "failures_total", Value: 1, add: true}, {Name: "failures_total", Value: 1, add: true}},
+			want:    []metricSeries{{Name: "failures_total", Value: 2, add: true}},
+		},
+		{
+			name:    "series are told apart by labels",
+			series:  []metricSeries{{Name: "duration_sum", Labels: success, Value: 10}},
+			updates: []metricSeries{{Name: "duration_sum", Labels: failure, Value: 4, add: true}, {Name: "duration_sum", Labels: success, Value: 5, add: true}},
+			want:    []metricSeries{{Name: "duration_sum", Labels: success, Value: 15}, {Name: "duration_sum", Labels: failure, Value: 4, add: true}},
+		},
+		{
+			name:    "label order does not matter",
+			series:  []metricSeries{{Name: "duration_sum", Labels: map[string]string{"result": "success", "stage": "prepare"}, Value: 10}},
+			updates: []metricSeries{{Name: "duration_sum", Labels: success, Value: 5, add: true}},
+			want:    []metricSeries{{Name: "duration_sum", Labels: success, Value: 15}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeMetrics(tt.series, tt.updates); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeMetrics() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Stages are separate processes, which merge their metrics through the
+// state file.
+func TestMetricsStateMerge(t *testing.T) {
+	dir := t.TempDir()
+	saved := cli
+	defer func() { cli = saved }()
+	cli.MetricsState = filepath.Join(dir, "state.json")
+	cli.MetricsTextfile = filepath.Join(dir, "metrics.prom")
+
+	for _, result := range []string{"success", "system_failure", "success"} {
+		var m Metrics
+		m.StartStage(context.Background(), "prepare")
+		m.Set(metricsPrefix+"active_vms", 2, "namespace", "ci")
+		m.Finish(result)
+	}
+
+	data, err := os.ReadFile(cli.MetricsTextfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exposition := string(data)
+	for _, want := range []string{
+		"# TYPE gitlab_runner_kubevirt_stage_duration_seconds summary\n",
+		`gitlab_runner_kubevirt_stage_duration_seconds_count{result="success",stage="prepare"} 2` + "\n",
+		`gitlab_runner_kubevirt_stage_duration_seconds_count{result="system_failure",stage="prepare"} 1` + "\n",
+		`gitlab_runner_kubevirt_failures_total{stage="prepare",type="system_failure"} 1` + "\n",
+		`gitlab_runner_kubevirt_active_vms{namespace="ci"} 2` + "\n",
+	} {
+		if !strings.Contains(exposition, want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, exposition)
+		}
+	}
+
+	if _, err := os.Stat(cli.MetricsState); err != nil {
+		t.Errorf("metrics state: %v", err)
+	}
+}
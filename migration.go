@@ -0,0 +1,176 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"barney.ci/shutil"
+	"github.com/helloyi/go-sshclient"
+	"golang.org/x/crypto/ssh"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// RunResumable runs the argv of the script detached from the ssh session, so that it
+// keeps running when the session gets cut, and follows its output until it
+// exits. If the connection gets lost because the VM is being live-migrated,
+// RunResumable reconnects once the migration is over, and resumes following
+// the output where it left off.
+//
+// The stdout and stderr of the script are both reported on stdout. The
+// returned error is an *ssh.ExitError if the script failed.
+func RunResumable(
+	ctx context.Context,
+	client kubevirt.KubevirtClient,
+	jctx *JobContext,
+	conn *sshclient.Client,
+	rc RunConfig,
+	argv []string,
+	scriptPath string,
+	retryTimeout, dialTimeout time.Duration,
+) error {
+	var (
+		logPath    = scriptPath + ".log"
+		statusPath = scriptPath + ".status"
+		pidPath    = scriptPath + ".pid"
+	)
+
+	start := time.Now()
+
+	wrapper := fmt.Sprintf("echo $$ > %s; %s > %s 2>&1 < /dev/null; echo $? > %s.tmp; mv %s.tmp %s",
+		quote(pidPath), shutil.Quote(argv), quote(logPath), quote(statusPath), quote(statusPath), quote(statusPath))
+	launch := fmt.Sprintf("rm -f %s %s; nohup setsid sh -c %s > /dev/null 2>&1 &",
+		quote(pidPath), quote(statusPath), quote(wrapper))
+
+	fmt.Fprintf(Debug, "launching %v\n", launch)
+	if err := conn.Cmd(launch).Run(); err != nil {
+		return err
+	}
+
+	// Connections made after migrations are ours to close, unlike the
+	// one of the caller.
+	callerConn := conn
+	defer func() {
+		if conn != callerConn {
+			conn.Close()
+		}
+	}()
+
+	out := &countingWriter{w: os.Stdout}
+	for {
+		// tail exits once the script does, after which the exit status of
+		// the script is reported as the exit status of the command.
+		follow := fmt.Sprintf(`while [ ! -e %[1]s ]; do sleep 1; done; tail -c +%[2]d --pid="$(cat %[1]s)" -f %[3]s; exit "$(cat %[4]s 2>/dev/null || echo 1)"`,
+			quote(pidPath), out.n+1, quote(logPath), quote(statusPath))
+
+		fmt.Fprintf(Debug, "following %v\n", follow)
+		err := RunCommand(ctx, conn, follow, out, os.Stderr)
+		if ctx.Err() != nil {
+			killScript(conn, pidPath)
+			return err
+		}
+
+		var exiterr *ssh.ExitError
+		if err == nil || errors.As(err, &exiterr) {
+			return err
+		}
+		_ = conn.Close()
+
+		next, rerr := reconnectAfterMigration(ctx, client, jctx, rc, start, retryTimeout, dialTimeout)
+		if rerr != nil {
+			return rerr
+		}
+		if next == nil {
+			return err
+		}
+		conn = next
+	}
+}
+
+// killScript terminates the script launched by RunResumable, which runs
+// detached from the ssh session. The connection may be broken at this
+// point, so this is bounded in time, and best-effort.
+func killScript(conn *sshclient.Client, pidPath string) {
+	ctx, stop := context.WithTimeout(context.Background(), 10*time.Second)
+	defer stop()
+
+	kill := fmt.Sprintf(`kill -TERM -- -"$(cat %s)"`, quote(pidPath))
+	if err := RunCommand(ctx, conn, kill, io.Discard, io.Discard); err != nil {
+		fmt.Fprintf(Debug, "terminating the script: %v\n", err)
+	}
+}
+
+// reconnectAfterMigration waits for the live-migration of the job VM that
+// cut the connection to be over, and reconnects to it. It returns a nil
+// connection if the VM was not migrated.
+func reconnectAfterMigration(
+	ctx context.Context,
+	client kubevirt.KubevirtClient,
+	jctx *JobContext,
+	rc RunConfig,
+	since time.Time,
+	retryTimeout, dialTimeout time.Duration,
+) (*sshclient.Client, error) {
+	ctx, stop := context.WithTimeout(ctx, retryTimeout)
+	defer stop()
+
+	vm, migrated, err := waitForMigration(ctx, client, jctx, since)
+	if err != nil || !migrated {
+		return nil, err
+	}
+
+	fmt.Fprintln(os.Stderr, "Virtual Machine instance was live-migrated, reconnecting...")
+	return ConnectSSH(ctx, client, vm, rc, dialTimeout)
+}
+
+// waitForMigration checks whether the job VM has been live-migrated since
+// the specified time, and waits for the migration to be over if so.
+func waitForMigration(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext, since time.Time) (*kubevirtapi.VirtualMachineInstance, bool, error) {
+	for {
+		vm, err := FindJobVM(ctx, client, jctx)
+		if err != nil {
+			return nil, false, err
+		}
+
+		state := vm.Status.MigrationState
+		if state == nil || state.StartTimestamp == nil || state.StartTimestamp.Time.Before(since) {
+			return vm, false, nil
+		}
+		// Failed migrations leave the VM running on its original node, but
+		// may still have cut the connection.
+		if state.Completed || state.Failed {
+			return vm, true, nil
+		}
+
+		select {
+		case <-time.After(2 * time.Second):
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+}
+
+func quote(arg string) string {
+	return shutil.Quote([]string{arg})
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,230 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+
+	k8sapi "k8s.io/api/core/v1"
+	networkingapi "k8s.io/api/networking/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// NetworkPolicyConfig describes the traffic allowed to and from job VMs when
+// they are isolated with a NetworkPolicy.
+type NetworkPolicyConfig struct {
+	// SSHPort is the port the runner connects to.
+	SSHPort string
+	// RunnerNamespace is the namespace of the runner pod.
+	RunnerNamespace string
+	// RunnerSelector selects the runner pod; ssh is allowed from any pod of
+	// RunnerNamespace if it is empty.
+	RunnerSelector map[string]string
+	// DNSNamespace is the namespace of the cluster DNS pods.
+	DNSNamespace string
+	// DNSSelector selects the cluster DNS pods, which are the only ones job
+	// VMs may send DNS queries to.
+	DNSSelector map[string]string
+	// Egress lists the CIDRs or domain names job VMs may connect to.
+	Egress []string
+	// ExposedPorts lists the ports exposed by the job, which are allowed
+	// from anywhere.
+	ExposedPorts []k8sapi.ServicePort
+}
+
+func jobNetworkPolicyName(jctx *JobContext) string {
+	return "job-" + jctx.ID
+}
+
+// CreateJobNetworkPolicy creates a NetworkPolicy isolating the virt-launcher
+// pod of the job VM, which only allows ssh from the runner, DNS, and egress
+// to the configured CIDRs. The policy selects the pod by label, so that it
+// can be created before the VM and be in effect as soon as the VM boots.
+func CreateJobNetworkPolicy(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext, config NetworkPolicyConfig) error {
+	cidrs, err := resolveCIDRs(ctx, config.Egress)
+	if err != nil {
+		return err
+	}
+	policy, err := jobNetworkPolicy(jctx, config, cidrs)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.NetworkingV1().NetworkPolicies(jctx.Namespace).Create(ctx, policy, metav1.CreateOptions{})
+	if k8serrors.IsAlreadyExists(err) {
+		// Created by a previous attempt at preparing the job.
+		return nil
+	}
+	return err
+}
+
+// jobNetworkPolicy returns the NetworkPolicy of the job VM, allowing egress
+// to the specified CIDRs.
+func jobNetworkPolicy(jctx *JobContext, config NetworkPolicyConfig, cidrs []string) (*networkingapi.NetworkPolicy, error) {
+	port, err := strconv.Atoi(config.SSHPort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ssh port %q: %w", config.SSHPort, err)
+	}
+	sshPort := intstr.FromInt(port)
+	dnsPort := intstr.FromInt(53)
+	tcp, udp := k8sapi.ProtocolTCP, k8sapi.ProtocolUDP
+
+	runnerNamespace := config.RunnerNamespace
+	if runnerNamespace == "" {
+		runnerNamespace = jctx.Namespace
+	}
+
+	if len(config.DNSSelector) == 0 {
+		// Port 53 of any host would be a way out.
+		return nil, fmt.Errorf("the NetworkPolicy of job VMs needs a selector of the cluster DNS pods")
+	}
+	dnsNamespace := config.DNSNamespace
+	if dnsNamespace == "" {
+		dnsNamespace = "kube-system"
+	}
+
+	egress := []networkingapi.NetworkPolicyEgressRule{
+		{
+			Ports: []networkingapi.NetworkPolicyPort{
+				{Protocol: &udp, Port: &dnsPort},
+				{Protocol: &tcp, Port: &dnsPort},
+			},
+			To: []networkingapi.NetworkPolicyPeer{
+				{
+					NamespaceSelector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{
+							"kubernetes.io/metadata.name": dnsNamespace,
+						},
+					},
+					PodSelector: &metav1.LabelSelector{
+						MatchLabels: config.DNSSelector,
+					},
+				},
+			},
+		},
+		{
+			To: []networkingapi.NetworkPolicyPeer{
+				{
+					PodSelector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{
+							serviceOfLabel: jctx.ID,
+						},
+					},
+				},
+			},
+		},
+	}
+	if len(cidrs) > 0 {
+		var peers []networkingapi.NetworkPolicyPeer
+		for _, cidr := range cidrs {
+			peers = append(peers, networkingapi.NetworkPolicyPeer{
+				IPBlock: &networkingapi.IPBlock{CIDR: cidr},
+			})
+		}
+		egress = append(egress, networkingapi.NetworkPolicyEgressRule{To: peers})
+	}
+
+	policy := networkingapi.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: jobNetworkPolicyName(jctx),
+			Labels: map[string]string{
+				labelPrefix + "/id":      jctx.ID,
+				labelPrefix + "/project": jctx.ProjectID,
+			},
+		},
+		Spec: networkingapi.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					labelPrefix + "/id": jctx.ID,
+				},
+			},
+			PolicyTypes: []networkingapi.PolicyType{
+				networkingapi.PolicyTypeIngress,
+				networkingapi.PolicyTypeEgress,
+			},
+			Ingress: []networkingapi.NetworkPolicyIngressRule{
+				{
+					Ports: []networkingapi.NetworkPolicyPort{
+						{Protocol: &tcp, Port: &sshPort},
+					},
+					From: []networkingapi.NetworkPolicyPeer{
+						{
+							NamespaceSelector: &metav1.LabelSelector{
+								MatchLabels: map[string]string{
+									"kubernetes.io/metadata.name": runnerNamespace,
+								},
+							},
+							PodSelector: &metav1.LabelSelector{
+								MatchLabels: config.RunnerSelector,
+							},
+						},
+					},
+				},
+			},
+			Egress: egress,
+		},
+	}
+
+	if len(config.ExposedPorts) > 0 {
+		var ports []networkingapi.NetworkPolicyPort
+		for _, exposed := range config.ExposedPorts {
+			port, protocol := exposed.TargetPort, exposed.Protocol
+			ports = append(ports, networkingapi.NetworkPolicyPort{Protocol: &protocol, Port: &port})
+		}
+		policy.Spec.Ingress = append(policy.Spec.Ingress, networkingapi.NetworkPolicyIngressRule{Ports: ports})
+	}
+	return &policy, nil
+}
+
+// resolveCIDRs turns a list of CIDRs, IPs, and domain names into CIDRs.
+// NetworkPolicies only support CIDRs, so domain names are resolved once,
+// when the policy is created.
+func resolveCIDRs(ctx context.Context, entries []string) ([]string, error) {
+	var cidrs []string
+	for _, entry := range entries {
+		if _, _, err := net.ParseCIDR(entry); err == nil {
+			cidrs = append(cidrs, entry)
+			continue
+		}
+
+		var ips []net.IP
+		if ip := net.ParseIP(entry); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			addrs, err := net.DefaultResolver.LookupIPAddr(ctx, entry)
+			if err != nil {
+				return nil, fmt.Errorf("resolving egress destination %s: %w", entry, err)
+			}
+			for _, addr := range addrs {
+				ips = append(ips, addr.IP)
+			}
+		}
+
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				cidrs = append(cidrs, ip.String()+"/32")
+			} else {
+				cidrs = append(cidrs, ip.String()+"/128")
+			}
+		}
+	}
+	return cidrs, nil
+}
+
+// DeleteJobNetworkPolicy deletes the NetworkPolicy of the job VM, if any.
+func DeleteJobNetworkPolicy(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) error {
+	err := client.NetworkingV1().NetworkPolicies(jctx.Namespace).Delete(ctx, jobNetworkPolicyName(jctx), metav1.DeleteOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
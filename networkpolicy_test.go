@@ -0,0 +1,76 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	k8sapi "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestJobNetworkPolicy(t *testing.T) {
+	jctx := &JobContext{ID: "1234-1", ProjectID: "42", Namespace: "ci"}
+	dns := map[string]string{"k8s-app": "kube-dns"}
+
+	tests := []struct {
+		name   string
+		config NetworkPolicyConfig
+		cidrs  []string
+	}{
+		{"no egress", NetworkPolicyConfig{SSHPort: "22", DNSSelector: dns}, nil},
+		{"egress", NetworkPolicyConfig{SSHPort: "22", DNSSelector: dns}, []string{"10.20.0.0/16", "192.0.2.1/32"}},
+		{
+			name: "exposed ports",
+			config: NetworkPolicyConfig{
+				SSHPort:      "2222",
+				DNSNamespace: "dns",
+				DNSSelector:  dns,
+				ExposedPorts: []k8sapi.ServicePort{{Protocol: k8sapi.ProtocolTCP, TargetPort: intstr.FromInt(8080)}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := jobNetworkPolicy(jctx, tt.config, tt.cidrs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A rule without peers allows its ports to any host.
+			for i, rule := range policy.Spec.Egress {
+				if len(rule.To) == 0 {
+					t.Errorf("egress rule %d has no peer: %+v", i, rule)
+				}
+			}
+
+			dnsRule := policy.Spec.Egress[0]
+			wantNamespace := tt.config.DNSNamespace
+			if wantNamespace == "" {
+				wantNamespace = "kube-system"
+			}
+			if len(dnsRule.To) != 1 {
+				t.Fatalf("DNS egress rule has peers %+v, want the cluster DNS pods", dnsRule.To)
+			}
+			peer := dnsRule.To[0]
+			if peer.IPBlock != nil || peer.NamespaceSelector == nil || peer.PodSelector == nil {
+				t.Fatalf("DNS egress peer is %+v, want the cluster DNS pods", peer)
+			}
+			if got := peer.NamespaceSelector.MatchLabels["kubernetes.io/metadata.name"]; got != wantNamespace {
+				t.Errorf("DNS egress peer is in namespace %q, want %q", got, wantNamespace)
+			}
+			if !reflect.DeepEqual(peer.PodSelector.MatchLabels, dns) {
+				t.Errorf("DNS egress peer selects pods %v, want %v", peer.PodSelector.MatchLabels, dns)
+			}
+		})
+	}
+
+	t.Run("no DNS selector", func(t *testing.T) {
+		if _, err := jobNetworkPolicy(jctx, NetworkPolicyConfig{SSHPort: "22"}, nil); err == nil {
+			t.Error("jobNetworkPolicy() without a DNS selector succeeded, want an error")
+		}
+	})
+}
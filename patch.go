@@ -0,0 +1,78 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// PatchSpec applies the specified patch to the spec of the instance. The
+// patch may be written in YAML or JSON, and is either a JSON merge patch
+// (RFC 7386) or a Kubernetes strategic merge patch.
+func PatchSpec(vmi *kubevirtapi.VirtualMachineInstance, patchType, patch string) error {
+	patchJSON, err := yaml.YAMLToJSON([]byte(patch))
+	if err != nil {
+		return fmt.Errorf("parsing VMI patch: %w", err)
+	}
+
+	specJSON, err := json.Marshal(&vmi.Spec)
+	if err != nil {
+		return err
+	}
+
+	switch patchType {
+	case "strategic":
+		specJSON, err = strategicpatch.StrategicMergePatch(specJSON, patchJSON, kubevirtapi.VirtualMachineInstanceSpec{})
+		if err != nil {
+			return fmt.Errorf("applying VMI patch: %w", err)
+		}
+	case "merge":
+		var spec, patch interface{}
+		if err := json.Unmarshal(specJSON, &spec); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(patchJSON, &patch); err != nil {
+			return fmt.Errorf("parsing VMI patch: %w", err)
+		}
+		specJSON, err = json.Marshal(mergePatch(spec, patch))
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown VMI patch type %q", patchType)
+	}
+
+	var spec kubevirtapi.VirtualMachineInstanceSpec
+	if err := json.Unmarshal(specJSON, &spec); err != nil {
+		return fmt.Errorf("applying VMI patch: %w", err)
+	}
+	vmi.Spec = spec
+	return nil
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = map[string]interface{}{}
+	}
+	for k, v := range patchObj {
+		if v == nil {
+			delete(targetObj, k)
+		} else {
+			targetObj[k] = mergePatch(targetObj[k], v)
+		}
+	}
+	return targetObj
+}
@@ -7,33 +7,176 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"path"
+	"strings"
+	"sync"
 	"time"
 
+	k8sapi "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
 	kubevirtapi "kubevirt.io/api/core/v1"
 	kubevirt "kubevirt.io/client-go/kubecli"
 )
 
 type PrepareCmd struct {
-	DefaultImage                   string        `name:"default-image"`
-	DefaultImagePullPolicy         string        `name:"default-image-pull-policy"`
-	DefaultImagePullSecret         string        `name:"default-image-pull-secret"`
-	DefaultCPURequest              string        `name:"default-cpu-request" default:"1"`
-	DefaultCPULimit                string        `name:"default-cpu-limit" default:"1"`
-	DefaultMemoryRequest           string        `name:"default-memory-request" default:"1Gi"`
-	DefaultMemoryLimit             string        `name:"default-memory-limit" default:"1Gi"`
-	DefaultEphemeralStorageRequest string        `name:"default-ephemeral-storage-request"`
-	DefaultEphemeralStorageLimit   string        `name:"default-ephemeral-storage-limit"`
-	DefaultTimezone                string        `name:"default-timezone" default:"Etc/UTC" env:"CUSTOM_ENV_VM_TIMEZONE"`
-	Timeout                        time.Duration `name:"timeout" default:"1h"`
-	DialTimeout                    time.Duration `default:"10s"`
+	DefaultImage                   string            `name:"default-image"`
+	DefaultArch                    string            `name:"default-arch" help:"Architecture of job VMs (e.g. amd64 or arm64); if unset, job VMs may run on nodes of any architecture"`
+	DefaultArchImages              map[string]string `name:"default-arch-images" mapsep:"," help:"Default image of job VMs for each architecture, as comma-separated <arch>=<image> pairs"`
+	AllowedImages                  []string          `name:"allowed-images" sep:"," help:"Comma-separated glob patterns of the images jobs are allowed to use"`
+	DeniedImages                   []string          `name:"denied-images" sep:"," help:"Comma-separated glob patterns of the images jobs are not allowed to use"`
+	DefaultMachineType             string            `name:"default-machine-type" help:"Machine type of job VMs (e.g. q35, pc, or a versioned machine type)"`
+	AllowedMachineTypes            []string          `name:"allowed-machine-types" sep:"," help:"Machine types that jobs are allowed to request"`
+	ArchMachineTypes               map[string]string `name:"arch-machine-types" mapsep:"," default:"arm64=virt" help:"Default machine type of job VMs for each architecture, as comma-separated <arch>=<machine type> pairs"`
+	DefaultRootPVC                 string            `name:"default-root-pvc" xor:"root-pvc" help:"PVC, as [<namespace>/]<name>, from which the root disk of job VMs is cloned instead of using a containerdisk"`
+	DefaultRootDataSource          string            `name:"default-root-datasource" xor:"root-pvc" help:"DataSource, as [<namespace>/]<name>, from which the root disk of job VMs is cloned instead of using a containerdisk"`
+	DefaultRootSnapshot            string            `name:"default-root-snapshot" xor:"root-pvc" help:"VolumeSnapshot in the runner namespace from which the root disk of job VMs is restored instead of using a containerdisk"`
+	DefaultRootDiskSize            string            `name:"default-root-disk-size" help:"Size of the root disk of job VMs, when it is an imported or cloned DataVolume"`
+	MaxRootDiskSize                string            `name:"max-root-disk-size" help:"Maximum root disk size that jobs are allowed to request"`
+	StorageClassName               string            `name:"storage-class" help:"Storage class of the volumes created for job VMs"`
+	VolumeMode                     string            `name:"volume-mode" help:"Volume mode (Block or Filesystem) of the volumes created for job VMs"`
+	AccessModes                    []string          `name:"access-modes" sep:"," help:"Comma-separated access modes of the volumes created for job VMs (e.g. ReadWriteMany)"`
+	DefaultRootDiskBus             string            `name:"default-root-disk-bus" help:"Bus of the root disk of job VMs (virtio, sata, or scsi)"`
+	ContainerDisks                 []string          `name:"containerdisk" help:"Containerdisk image to attach to job VMs as a secondary disk, optionally followed by =<bus> (virtio, sata, or scsi)"`
+	DefaultScratchDiskSize         string            `name:"default-scratch-disk-size" help:"Size of the empty scratch disk attached to job VMs"`
+	ScratchDiskMountPoint          string            `name:"scratch-disk-mount-point" help:"Path where the scratch disk gets formatted and mounted via cloud-init"`
+	HotplugVolumes                 []string          `name:"hotplug-volume" help:"Name of a PVC to hotplug into job VMs once they are running"`
+	AllowedHotplugVolumes          []string          `name:"allowed-hotplug-volumes" sep:"," help:"PVCs that jobs are allowed to hotplug into their VM"`
+	CacheSize                      string            `name:"cache-size" help:"Size of the per-project cache volume; if unset, job VMs get no cache volume"`
+	CacheDir                       string            `name:"cache-dir" default:"/cache" help:"Path where the cache volume gets mounted via cloud-init; must match the --cache-dir of the config stage"`
+	BuildsPVC                      string            `name:"builds-pvc" help:"Name of a PVC shared with job VMs via virtiofs, and mounted as the builds directory"`
+	BuildsDir                      string            `name:"builds-dir" default:"/builds" help:"Path where the builds PVC gets mounted via cloud-init; must match the --builds-dir of the config stage"`
+	ConfigMaps                     []string          `name:"configmap" help:"Name of a ConfigMap to attach to job VMs as a disk, optionally followed by =<volume label>"`
+	Secrets                        []string          `name:"secret" help:"Name of a Secret to attach to job VMs as a disk, optionally followed by =<volume label>"`
+	DownwardAPI                    bool              `name:"downward-api" help:"Attach a disk exposing the metadata of the VM, such as the job labels and annotations, to job VMs"`
+	DefaultServiceAccount          string            `name:"default-service-account" help:"Service account whose token is exposed to job VMs"`
+	AllowedServiceAccounts         []string          `name:"allowed-service-accounts" sep:"," help:"Service accounts that jobs are allowed to request"`
+	IOThreadsPolicy                string            `name:"io-threads-policy" help:"Whether disks of job VMs share a single IO thread (shared), or get spread across a pool of IO threads (auto)"`
+	DedicatedIOThreads             []string          `name:"dedicated-io-threads" sep:"," help:"Comma-separated names of the disks of job VMs that get their own IO thread"`
+	BlockMultiQueue                bool              `name:"block-multi-queue" help:"Give the virtio disks of job VMs one queue per vCPU"`
+	DefaultBootOrder               []string          `name:"default-boot-order" sep:"," help:"Comma-separated names of the disks and interfaces of job VMs, in the order they are booted from"`
+	DefaultImagePullPolicy         string            `name:"default-image-pull-policy"`
+	AllowedPullPolicies            []string          `name:"allowed-pull-policies" sep:"," help:"Pull policies that jobs are allowed to request; defaults to --default-image-pull-policy"`
+	DefaultImagePullSecret         string            `name:"default-image-pull-secret"`
+	JobRegistryCredentials         bool              `name:"job-registry-credentials" help:"Pull the containerdisks of jobs with their registry credentials, when no pull secret is set"`
+	DefaultCPURequest              string            `name:"default-cpu-request" default:"1"`
+	DefaultCPULimit                string            `name:"default-cpu-limit" default:"1"`
+	DefaultMemoryRequest           string            `name:"default-memory-request" default:"1Gi"`
+	DefaultMemoryLimit             string            `name:"default-memory-limit" default:"1Gi"`
+	DefaultEphemeralStorageRequest string            `name:"default-ephemeral-storage-request"`
+	DefaultEphemeralStorageLimit   string            `name:"default-ephemeral-storage-limit"`
+	DefaultHugepagesPageSize       string            `name:"default-hugepages-page-size" help:"Size of the hugepages backing the memory of job VMs (e.g. 2Mi or 1Gi)"`
+	GuestMemory                    string            `name:"guest-memory" help:"Amount of memory seen by the guest, independently from memory requests"`
+	DefaultCPUModel                string            `name:"default-cpu-model" help:"CPU model of job VMs (e.g. host-passthrough, host-model, or a named model)"`
+	DefaultCPUFeatures             []string          `name:"default-cpu-features" sep:"," help:"CPU features of job VMs, as comma-separated <name>[=<policy>] entries"`
+	DefaultCPUSockets              uint32            `name:"default-cpu-sockets" help:"Number of CPU sockets of job VMs"`
+	DefaultCPUCores                uint32            `name:"default-cpu-cores" help:"Number of CPU cores per socket of job VMs"`
+	DefaultCPUThreads              uint32            `name:"default-cpu-threads" help:"Number of CPU threads per core of job VMs"`
+	DedicatedCPUPlacement          bool              `name:"dedicated-cpu-placement" help:"Pin the vCPUs of job VMs to dedicated host CPUs"`
+	NUMAPassthrough                bool              `name:"numa-passthrough" help:"Pass the host NUMA topology through to job VMs; requires --dedicated-cpu-placement and hugepages"`
+	Firmware                       string            `name:"firmware" default:"bios" enum:"bios,efi" help:"Firmware used to boot job VMs"`
+	SecureBoot                     bool              `name:"secure-boot" help:"Enable Secure Boot on job VMs; requires --firmware=efi"`
+	TPM                            bool              `name:"tpm" help:"Attach an emulated TPM to job VMs"`
+	RNG                            bool              `name:"rng" default:"true" negatable:"" help:"Attach a virtio-rng device to job VMs"`
+	DefaultHyperv                  bool              `name:"default-hyperv" help:"Enable the standard set of Hyper-V enlightenments on job VMs"`
+	KVMHidden                      bool              `name:"kvm-hidden" help:"Hide the KVM hypervisor signature from job VMs"`
+	HypervVendorID                 string            `name:"hyperv-vendor-id" help:"Hypervisor vendor ID exposed to job VMs, up to 12 characters"`
+	DefaultTimezone                string            `name:"default-timezone" default:"Etc/UTC" env:"CUSTOM_ENV_VM_TIMEZONE"`
+	ClockOffset                    string            `name:"clock-offset" default:"timezone" enum:"timezone,utc" help:"Whether the guest clock is kept in the default timezone, or in UTC"`
+	Timers                         []string          `name:"timers" sep:"," default:"hyperv,rtc=catchup" help:"Timers of job VMs, as comma-separated <name>[=<tick policy>|off] entries"`
+	DefaultInstancetype            string            `name:"default-instancetype"`
+	DefaultInstancetypeKind        string            `name:"default-instancetype-kind" default:"VirtualMachineClusterInstancetype" enum:"VirtualMachineInstancetype,VirtualMachineClusterInstancetype"`
+	DefaultPreference              string            `name:"default-preference"`
+	DefaultPreferenceKind          string            `name:"default-preference-kind" default:"VirtualMachineClusterPreference" enum:"VirtualMachinePreference,VirtualMachineClusterPreference"`
+	DefaultNodeSelector            map[string]string `name:"default-node-selector" mapsep:","`
+	Labels                         map[string]string `name:"label" mapsep:"," help:"Labels of job VMs, as comma-separated <key>=<value> pairs"`
+	Annotations                    map[string]string `name:"annotation" mapsep:"," help:"Annotations of job VMs, as comma-separated <key>=<value> pairs"`
+	DefaultGPUs                    map[string]int    `name:"default-gpus" mapsep:"," help:"GPUs attached to job VMs, as comma-separated <device name>=<count> pairs"`
+	SRIOVNetworks                  []string          `name:"sriov-network" help:"Name of a SR-IOV NetworkAttachmentDefinition to attach job VMs to"`
+	PrimaryNetwork                 string            `name:"primary-network" help:"Name of a NetworkAttachmentDefinition to attach job VMs to instead of the pod network, optionally followed by =<binding> (bridge, masquerade, sriov, or macvtap)"`
+	Networks                       []string          `name:"network" help:"Name of a NetworkAttachmentDefinition to attach job VMs to, optionally followed by =<binding> (bridge, masquerade, sriov, or macvtap)"`
+	Istio                          bool              `name:"istio" help:"Inject the Istio sidecar into job VMs, and exclude ssh from it"`
+	Services                       bool              `name:"services" help:"Run the services of jobs as pods, reachable from job VMs by their aliases"`
+	ExposeServiceType              string            `name:"expose-service-type" default:"ClusterIP" enum:"ClusterIP,NodePort" help:"Type of the Service exposing the ports requested by jobs"`
+	NetworkPolicy                  bool              `name:"network-policy" help:"Isolate job VMs with a NetworkPolicy only allowing ssh from the runner, DNS, and the egress CIDRs"`
+	NetworkPolicyRunnerNamespace   string            `name:"network-policy-runner-namespace" help:"Namespace of the runner pod; defaults to the namespace of job VMs"`
+	NetworkPolicyRunnerSelector    map[string]string `name:"network-policy-runner-selector" mapsep:"," help:"Labels of the runner pod"`
+	NetworkPolicyEgress            []string          `name:"network-policy-egress" help:"CIDR or domain name job VMs are allowed to connect to"`
+	NetworkPolicyDNSNamespace      string            `name:"network-policy-dns-namespace" default:"kube-system" help:"Namespace of the cluster DNS pods"`
+	NetworkPolicyDNSSelector       map[string]string `name:"network-policy-dns-selector" mapsep:"," default:"k8s-app=kube-dns" help:"Labels of the cluster DNS pods, which are the only ones job VMs may send DNS queries to"`
+	RestrictEgress                 bool              `name:"restrict-egress" help:"Force the isolation of all job VMs with a NetworkPolicy, and refuse options that would bypass it"`
+	PriorityClassName              string            `name:"priority-class-name" help:"Priority class of job VMs"`
+	AllowedPriorityClassNames      []string          `name:"allowed-priority-class-names" sep:"," help:"Priority classes that jobs are allowed to request"`
+	SchedulerName                  string            `name:"scheduler-name" help:"Name of the scheduler responsible for scheduling job VMs"`
+	TerminationGracePeriod         time.Duration     `name:"termination-grace-period" help:"How long job VMs are given to shut down cleanly before getting killed; defaults to the KubeVirt default"`
+	DefaultHostname                string            `name:"default-hostname" default:"job-{{ .JobID }}" help:"Hostname of job VMs, templated with the job context"`
+	Subdomain                      string            `name:"subdomain" help:"Subdomain of job VMs"`
+	DNSPolicy                      string            `name:"dns-policy" help:"DNS policy of job VMs (ClusterFirst, Default, or None)"`
+	DNSNameservers                 []string          `name:"dns-nameserver" help:"Additional nameserver of job VMs"`
+	DNSSearches                    []string          `name:"dns-search" help:"Additional DNS search domain of job VMs"`
+	DNSOptions                     []string          `name:"dns-option" help:"Additional resolver option of job VMs, as <name>[=<value>]"`
+	EvictionStrategy               string            `name:"eviction-strategy" help:"What happens to job VMs when their node is drained (None, LiveMigrate, or External); defaults to the cluster-wide eviction strategy"`
+	Affinity                       string            `name:"affinity" help:"Affinity rules of the VM, as a YAML or JSON document templated with the job context"`
+
+	TopologySpreadKeys              []string `name:"topology-spread-key" help:"Topology key across which job VMs are spread evenly"`
+	TopologySpreadMaxSkew           int32    `name:"topology-spread-max-skew" default:"1"`
+	TopologySpreadWhenUnsatisfiable string   `name:"topology-spread-when-unsatisfiable" default:"ScheduleAnyway" enum:"ScheduleAnyway,DoNotSchedule"`
+	TopologySpreadConstraints       string   `name:"topology-spread-constraints" help:"Topology spread constraints of the VM, as a YAML or JSON list templated with the job context; overrides --topology-spread-key"`
+
+	CloudInitType                  string `name:"cloud-init-type" default:"nocloud" enum:"nocloud,configdrive" help:"cloud-init data source used to provide user-data to job VMs"`
+	DefaultCloudInitUserData       string `name:"default-cloud-init-user-data" xor:"cloud-init-user-data" help:"cloud-init user-data of job VMs"`
+	DefaultCloudInitUserDataFile   string `name:"default-cloud-init-user-data-file" xor:"cloud-init-user-data" type:"existingfile" help:"Path to the cloud-init user-data of job VMs"`
+	DefaultCloudInitUserDataSecret string `name:"default-cloud-init-user-data-secret" xor:"cloud-init-user-data" help:"Name of the Secret containing the cloud-init user-data of job VMs"`
+
+	SysprepConfigMap   string `name:"sysprep-configmap" xor:"sysprep" help:"Name of the ConfigMap containing the autounattend.xml sysprep answer file of Windows job VMs"`
+	SysprepSecret      string `name:"sysprep-secret" xor:"sysprep" help:"Name of the Secret containing the autounattend.xml sysprep answer file of Windows job VMs"`
+	VirtioDriversImage string `name:"virtio-drivers-image" help:"Containerdisk image of the virtio-win drivers, attached to job VMs as a CD-ROM (e.g. quay.io/kubevirt/virtio-container-disk)"`
+
+	VMITemplate   string `name:"vmi-template" type:"existingfile" help:"Path to a VirtualMachineInstance manifest, templated with the job context, to use instead of the built-in VM spec"`
+	AllowVMIPatch bool   `name:"allow-vmi-patch" help:"Allow jobs to patch the spec of their VM with KUBEVIRT_VMI_PATCH"`
+
+	StepRunner string `name:"step-runner" help:"Path of a step-runner binary to install and start in job VMs"`
+
+	ReadinessProbe string `name:"readiness-probe" help:"Command that must succeed in job VMs, over ssh, before they are considered ready (e.g. 'cloud-init status --wait')"`
+
+	FailUnschedulable bool `name:"fail-unschedulable" default:"true" negatable:"" help:"Fail the job as soon as its VM cannot be scheduled, rather than waiting for the timeout"`
+
+	WaitGuestAgent bool `name:"wait-guest-agent" help:"Wait for the guest agent of job VMs to connect before considering them ready"`
+
+	CreateRetryTimeout time.Duration `name:"create-retry-timeout" default:"10m" help:"How long to retry creating job VMs when hitting a ResourceQuota or an unavailable admission webhook"`
+
+	MaxVMs       int           `name:"max-vms" help:"Maximum number of job VMs in the namespace; jobs wait for a slot beyond that"`
+	QueueTimeout time.Duration `name:"queue-timeout" help:"Timeout for jobs to get a slot under --max-vms; defaults to the timeout of the prepare stage"`
+
+	AllowedAnnotations []string `name:"allowed-annotations" sep:"," help:"Comma-separated glob patterns of the annotation keys jobs are allowed to set with KUBEVIRT_ANNOTATIONS, e.g. example.com/*"`
+
+	AllowedRootPVCs        []string `name:"allowed-root-pvcs" sep:"," help:"PVCs, as [<namespace>/]<name>, that jobs are allowed to clone their root disk from with KUBEVIRT_ROOT_PVC"`
+	AllowedRootDataSources []string `name:"allowed-root-datasources" sep:"," help:"DataSources, as [<namespace>/]<name>, that jobs are allowed to clone their root disk from with KUBEVIRT_ROOT_DATASOURCE"`
+	AllowedRootSnapshots   []string `name:"allowed-root-snapshots" sep:"," help:"VolumeSnapshots that jobs are allowed to restore their root disk from with KUBEVIRT_ROOT_SNAPSHOT"`
+
+	SchedulingTimeout time.Duration `name:"scheduling-timeout" help:"Timeout for job VMs to get scheduled on a node"`
+	BootTimeout       time.Duration `name:"boot-timeout" help:"Timeout for job VMs to boot, once scheduled"`
+	SSHTimeout        time.Duration `name:"ssh-timeout" help:"Timeout for the ssh server of job VMs to accept connections, once booted"`
+
+	Timeout     time.Duration `name:"timeout" help:"Timeout of the prepare stage; defaults to the job timeout plus --timeout-margin, or 1h"`
+	DialTimeout time.Duration `default:"10s"`
 
 	RunConfig `embed`
 }
 
 func (cmd *PrepareCmd) Run(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) error {
+	cmd.Timeout = stageTimeout(cmd.Timeout, jctx)
+
+	// All the waits of the stage share its deadline, rather than each
+	// getting the whole timeout of the stage.
+	timeout, stop := context.WithTimeout(ctx, cmd.Timeout)
+	defer stop()
+
 	if jctx.CPURequest == "" {
 		jctx.CPURequest = cmd.DefaultCPURequest
 	}
@@ -52,42 +195,614 @@ func (cmd *PrepareCmd) Run(ctx context.Context, client kubevirt.KubevirtClient,
 	if jctx.EphemeralStorageLimit == "" {
 		jctx.EphemeralStorageLimit = cmd.DefaultEphemeralStorageLimit
 	}
+	if jctx.HugepagesPageSize == "" {
+		jctx.HugepagesPageSize = cmd.DefaultHugepagesPageSize
+	}
+	if jctx.CPUModel == "" {
+		jctx.CPUModel = cmd.DefaultCPUModel
+	}
+	if jctx.CPUFeatures == nil {
+		jctx.CPUFeatures = cmd.DefaultCPUFeatures
+	}
+	if jctx.CPUSockets == 0 {
+		jctx.CPUSockets = cmd.DefaultCPUSockets
+	}
+	if jctx.CPUCores == 0 {
+		jctx.CPUCores = cmd.DefaultCPUCores
+	}
+	if jctx.CPUThreads == 0 {
+		jctx.CPUThreads = cmd.DefaultCPUThreads
+	}
+	jctx.GuestMemory = cmd.GuestMemory
+	jctx.DedicatedCPUPlacement = cmd.DedicatedCPUPlacement
+	jctx.NUMAPassthrough = cmd.NUMAPassthrough
+	jctx.Firmware = cmd.Firmware
+	jctx.SecureBoot = cmd.SecureBoot
+	jctx.TPM = cmd.TPM
+	jctx.RNG = cmd.RNG
+	jctx.Hyperv = jctx.Hyperv || cmd.DefaultHyperv
+	jctx.KVMHidden = cmd.KVMHidden
+	jctx.HypervVendorID = cmd.HypervVendorID
+	if jctx.ImagePullPolicy == "" && jctx.Job != nil {
+		policy, err := imagePullPolicy(jctx.Job.Image)
+		if err != nil {
+			return err
+		}
+		jctx.ImagePullPolicy = string(policy)
+	}
 	if jctx.ImagePullPolicy == "" {
 		jctx.ImagePullPolicy = cmd.DefaultImagePullPolicy
+	} else {
+		policy, err := parsePullPolicy(jctx.ImagePullPolicy)
+		if err != nil {
+			return err
+		}
+		if err := cmd.checkPullPolicy(policy); err != nil {
+			return err
+		}
+		jctx.ImagePullPolicy = string(policy)
+	}
+	if cmd.Services && jctx.Job != nil {
+		for _, service := range jctx.Job.Services {
+			policy, err := imagePullPolicy(service)
+			if err != nil {
+				return err
+			}
+			if policy == "" {
+				continue
+			}
+			if err := cmd.checkPullPolicy(policy); err != nil {
+				return fmt.Errorf("service %s: %w", service.Name, err)
+			}
+		}
 	}
 	if jctx.ImagePullSecret == "" {
 		jctx.ImagePullSecret = cmd.DefaultImagePullSecret
 	}
+	if jctx.Arch == "" {
+		jctx.Arch = cmd.DefaultArch
+	}
+	// Golden images may live in other namespaces, so jobs may only clone
+	// the allowed ones.
+	if jctx.RootPVC != "" && !namespacedNameAllowed(append(cmd.AllowedRootPVCs, cmd.DefaultRootPVC), jctx.RootPVC, jctx.Namespace) {
+		return fmt.Errorf("cloning the root disk from PVC %q is not allowed; allowed PVCs are %v", jctx.RootPVC, cmd.AllowedRootPVCs)
+	}
+	if jctx.RootDataSource != "" && !namespacedNameAllowed(append(cmd.AllowedRootDataSources, cmd.DefaultRootDataSource), jctx.RootDataSource, jctx.Namespace) {
+		return fmt.Errorf("cloning the root disk from DataSource %q is not allowed; allowed DataSources are %v", jctx.RootDataSource, cmd.AllowedRootDataSources)
+	}
+	if jctx.RootSnapshot != "" && !namespacedNameAllowed(append(cmd.AllowedRootSnapshots, cmd.DefaultRootSnapshot), jctx.RootSnapshot, jctx.Namespace) {
+		return fmt.Errorf("restoring the root disk from VolumeSnapshot %q is not allowed; allowed VolumeSnapshots are %v", jctx.RootSnapshot, cmd.AllowedRootSnapshots)
+	}
+	if jctx.Image == "" && jctx.RootPVC == "" && jctx.RootDataSource == "" && jctx.RootSnapshot == "" {
+		// Jobs that specify an image keep using a containerdisk
+		jctx.RootPVC = cmd.DefaultRootPVC
+		jctx.RootDataSource = cmd.DefaultRootDataSource
+		jctx.RootSnapshot = cmd.DefaultRootSnapshot
+	}
+	// Only the images requested by the job are subject to the policy, not
+	// the defaults of the runner.
+	var requested []string
+	if jctx.Image != "" {
+		requested = append(requested, jctx.Image)
+	}
+	for _, image := range jctx.ContainerDisks {
+		if idx := strings.LastIndex(image, "="); idx != -1 {
+			image = image[:idx]
+		}
+		requested = append(requested, image)
+	}
+	// Services run as pods of the runner namespace, so their images are
+	// subject to the policy too.
+	if cmd.Services && jctx.Job != nil {
+		for _, service := range jctx.Job.Services {
+			requested = append(requested, service.Name)
+		}
+	}
+	// Disk images get fetched by CDI from within the cluster, so jobs may
+	// only import the ones explicitly allowed.
+	if isImportedImage(jctx.Image) && len(cmd.AllowedImages) == 0 {
+		fmt.Fprintf(os.Stderr, "Image %s is a disk image, which jobs may only import if allowed with --allowed-images\n", jctx.Image)
+		buildFailureExit()
+	}
+	for _, image := range requested {
+		if !imageAllowed(cmd.AllowedImages, cmd.DeniedImages, image) {
+			fmt.Fprintf(os.Stderr, "Image %s is not allowed by the policy of this runner (allowed images: %v, denied images: %v)\n", image, cmd.AllowedImages, cmd.DeniedImages)
+			buildFailureExit()
+		}
+	}
+	if jctx.Image == "" {
+		jctx.Image = cmd.DefaultArchImages[jctx.Arch]
+	}
 	if jctx.Image == "" {
 		jctx.Image = cmd.DefaultImage
 	}
+	if jctx.MachineType == "" {
+		jctx.MachineType = cmd.ArchMachineTypes[jctx.Arch]
+	} else if !contains(cmd.AllowedMachineTypes, jctx.MachineType) {
+		return fmt.Errorf("machine type %q is not allowed; allowed machine types are %v", jctx.MachineType, cmd.AllowedMachineTypes)
+	}
+	if jctx.MachineType == "" {
+		jctx.MachineType = cmd.DefaultMachineType
+	}
+	if jctx.RootDiskSize == "" {
+		jctx.RootDiskSize = cmd.DefaultRootDiskSize
+	} else {
+		if !hasRootDataVolume(jctx) {
+			return fmt.Errorf("KUBEVIRT_DISK_SIZE is set, but the root disk of the job VM is a containerdisk, which cannot be resized")
+		}
+		if cmd.MaxRootDiskSize != "" {
+			size, err := resource.ParseQuantity(jctx.RootDiskSize)
+			if err != nil {
+				return fmt.Errorf("parsing root disk size: %w", err)
+			}
+			max, err := resource.ParseQuantity(cmd.MaxRootDiskSize)
+			if err != nil {
+				return fmt.Errorf("parsing maximum root disk size: %w", err)
+			}
+			if size.Cmp(max) > 0 {
+				return fmt.Errorf("root disk size %s exceeds the maximum of %s", jctx.RootDiskSize, cmd.MaxRootDiskSize)
+			}
+		}
+	}
+	jctx.StorageClassName = cmd.StorageClassName
+	jctx.VolumeMode = cmd.VolumeMode
+	jctx.AccessModes = cmd.AccessModes
+	if jctx.RootDiskBus == "" {
+		jctx.RootDiskBus = cmd.DefaultRootDiskBus
+	}
+	// Per-job containerdisks are attached after the ones of the runner
+	jctx.ContainerDisks = append(append([]string(nil), cmd.ContainerDisks...), jctx.ContainerDisks...)
+	if jctx.ScratchDiskSize == "" {
+		jctx.ScratchDiskSize = cmd.DefaultScratchDiskSize
+	}
+	for _, claim := range jctx.HotplugVolumes {
+		if !contains(cmd.AllowedHotplugVolumes, claim) {
+			return fmt.Errorf("hotplugging volume %q is not allowed; allowed volumes are %v", claim, cmd.AllowedHotplugVolumes)
+		}
+	}
+	// Per-job volumes are hotplugged after the ones of the runner
+	jctx.HotplugVolumes = append(append([]string(nil), cmd.HotplugVolumes...), jctx.HotplugVolumes...)
+	jctx.ConfigMaps = cmd.ConfigMaps
+	jctx.Secrets = cmd.Secrets
+	jctx.DownwardAPI = cmd.DownwardAPI
+	jctx.IOThreadsPolicy = cmd.IOThreadsPolicy
+	jctx.DedicatedIOThreads = cmd.DedicatedIOThreads
+	jctx.BlockMultiQueue = cmd.BlockMultiQueue
+	if jctx.BootOrder == nil {
+		jctx.BootOrder = cmd.DefaultBootOrder
+	}
 	if jctx.Timezone == "" {
 		jctx.Timezone = cmd.DefaultTimezone
 	}
+	jctx.ClockOffset = cmd.ClockOffset
+	jctx.Timers = cmd.Timers
+	if jctx.Instancetype == "" {
+		jctx.Instancetype = cmd.DefaultInstancetype
+	}
+	if jctx.InstancetypeKind == "" {
+		jctx.InstancetypeKind = cmd.DefaultInstancetypeKind
+	}
+	if jctx.Preference == "" {
+		jctx.Preference = cmd.DefaultPreference
+	}
+	if jctx.PreferenceKind == "" {
+		jctx.PreferenceKind = cmd.DefaultPreferenceKind
+	}
+	if jctx.PriorityClassName == "" {
+		jctx.PriorityClassName = cmd.PriorityClassName
+	} else if !contains(cmd.AllowedPriorityClassNames, jctx.PriorityClassName) {
+		return fmt.Errorf("priority class %q is not allowed; allowed priority classes are %v", jctx.PriorityClassName, cmd.AllowedPriorityClassNames)
+	}
+	jctx.SchedulerName = cmd.SchedulerName
+	jctx.EvictionStrategy = cmd.EvictionStrategy
+	if jctx.Hostname == "" {
+		hostname, err := RenderTemplate("hostname", cmd.DefaultHostname, jctx)
+		if err != nil {
+			return err
+		}
+		jctx.Hostname = hostname
+	}
+	jctx.Hostname = dnsLabel(jctx.Hostname)
+	jctx.Subdomain = cmd.Subdomain
+	jctx.DNSPolicy = cmd.DNSPolicy
+	if len(cmd.DNSNameservers) > 0 || len(cmd.DNSSearches) > 0 || len(cmd.DNSOptions) > 0 {
+		jctx.DNSConfig = &k8sapi.PodDNSConfig{
+			Nameservers: cmd.DNSNameservers,
+			Searches:    cmd.DNSSearches,
+		}
+		for _, option := range cmd.DNSOptions {
+			dnsOption := k8sapi.PodDNSConfigOption{Name: option}
+			if idx := strings.Index(option, "="); idx != -1 {
+				value := option[idx+1:]
+				dnsOption.Name, dnsOption.Value = option[:idx], &value
+			}
+			jctx.DNSConfig.Options = append(jctx.DNSConfig.Options, dnsOption)
+		}
+	}
+	jctx.TerminationGracePeriod = cmd.TerminationGracePeriod
+	if jctx.ServiceAccount == "" {
+		jctx.ServiceAccount = cmd.DefaultServiceAccount
+	} else if !contains(cmd.AllowedServiceAccounts, jctx.ServiceAccount) {
+		return fmt.Errorf("service account %q is not allowed; allowed service accounts are %v", jctx.ServiceAccount, cmd.AllowedServiceAccounts)
+	}
+	if cmd.RestrictEgress {
+		// NetworkPolicies only apply to the pod network, so VMs must not
+		// have other networks, be it through --network, --sriov-network,
+		// --primary-network, or a VMI patch adding Multus networks; service
+		// pods are not isolated. Per-job labels could get the VM selected by
+		// more permissive NetworkPolicies, and per-job annotations could
+		// change how its traffic is handled, e.g. with Istio ones.
+		switch {
+		case cmd.AllowVMIPatch:
+			return fmt.Errorf("--restrict-egress cannot be used with --allow-vmi-patch")
+		case cmd.PrimaryNetwork != "":
+			return fmt.Errorf("--restrict-egress cannot be used with --primary-network")
+		case cmd.Services:
+			return fmt.Errorf("--restrict-egress cannot be used with --services")
+		case len(cmd.Networks) > 0 || len(cmd.SRIOVNetworks) > 0:
+			return fmt.Errorf("--restrict-egress cannot be used with --network or --sriov-network")
+		case len(jctx.Labels) > 0:
+			return fmt.Errorf("KUBEVIRT_LABELS is set, but this runner restricts egress, which does not allow per-job labels")
+		case len(jctx.Annotations) > 0:
+			return fmt.Errorf("KUBEVIRT_ANNOTATIONS is set, but this runner restricts egress, which does not allow per-job annotations")
+		}
+	}
+	if jctx.VMIPatch != "" && !cmd.AllowVMIPatch {
+		return fmt.Errorf("KUBEVIRT_VMI_PATCH is set, but this runner does not allow patching VMs (see --allow-vmi-patch)")
+	}
+	if jctx.GPUs == nil {
+		jctx.GPUs = cmd.DefaultGPUs
+	}
+	if network := cmd.PrimaryNetwork; network != "" {
+		if cmd.Istio {
+			return fmt.Errorf("--istio cannot be used with --primary-network")
+		}
+		attachment := NetworkAttachment{NetworkName: network, Binding: "bridge", Default: true}
+		if idx := strings.LastIndex(network, "="); idx != -1 {
+			attachment.NetworkName, attachment.Binding = network[:idx], network[idx+1:]
+		}
+		jctx.Networks = append(jctx.Networks, attachment)
+	}
+	for _, network := range cmd.Networks {
+		attachment := NetworkAttachment{NetworkName: network, Binding: "bridge"}
+		if idx := strings.LastIndex(network, "="); idx != -1 {
+			attachment.NetworkName, attachment.Binding = network[:idx], network[idx+1:]
+		}
+		jctx.Networks = append(jctx.Networks, attachment)
+	}
+	for _, network := range cmd.SRIOVNetworks {
+		jctx.Networks = append(jctx.Networks, NetworkAttachment{NetworkName: network, Binding: "sriov"})
+	}
+	jctx.Istio = cmd.Istio
+	exposedPorts, err := parseServicePorts(jctx.ExposePorts)
+	if err != nil {
+		return err
+	}
+	if len(cmd.DefaultNodeSelector) > 0 {
+		// Per-job node selectors are merged on top of the defaults
+		nodeSelector := make(map[string]string, len(cmd.DefaultNodeSelector)+len(jctx.NodeSelector))
+		for k, v := range cmd.DefaultNodeSelector {
+			nodeSelector[k] = v
+		}
+		for k, v := range jctx.NodeSelector {
+			nodeSelector[k] = v
+		}
+		jctx.NodeSelector = nodeSelector
+	}
+	// Annotations configure KubeVirt and other controllers, e.g. hook
+	// sidecars running arbitrary images, so jobs may only set the allowed
+	// ones.
+	for key := range jctx.Annotations {
+		if !annotationAllowed(cmd.AllowedAnnotations, key) {
+			return fmt.Errorf("annotation %q is not allowed; allowed annotations are %v", key, cmd.AllowedAnnotations)
+		}
+	}
+	// Labels and annotations of the runner are merged on top of the per-job
+	// ones, so that jobs cannot override policy labels.
+	jctx.Labels = mergeMaps(jctx.Labels, cmd.Labels)
+	jctx.Annotations = mergeMaps(jctx.Annotations, cmd.Annotations)
+	if jctx.Arch != "" {
+		if jctx.NodeSelector == nil {
+			jctx.NodeSelector = map[string]string{}
+		}
+		jctx.NodeSelector[k8sapi.LabelArchStable] = jctx.Arch
+	}
 
-	rc := cmd.RunConfig
+	jctx.CloudInitType = cmd.CloudInitType
+	jctx.SysprepConfigMap = cmd.SysprepConfigMap
+	jctx.SysprepSecret = cmd.SysprepSecret
+	jctx.VirtioDriversImage = cmd.VirtioDriversImage
+	if jctx.CloudInitUserData == "" {
+		jctx.CloudInitUserData = cmd.DefaultCloudInitUserData
+		jctx.CloudInitUserDataSecret = cmd.DefaultCloudInitUserDataSecret
+		if cmd.DefaultCloudInitUserDataFile != "" {
+			userData, err := os.ReadFile(cmd.DefaultCloudInitUserDataFile)
+			if err != nil {
+				return err
+			}
+			jctx.CloudInitUserData = string(userData)
+		}
+	}
 
-	fmt.Fprintf(os.Stderr, "Creating Virtual Machine instance\n")
+	if cmd.VMITemplate != "" {
+		tmpl, err := os.ReadFile(cmd.VMITemplate)
+		if err != nil {
+			return err
+		}
+		jctx.VMITemplate = string(tmpl)
+	}
+
+	if cmd.Affinity != "" {
+		jctx.Affinity = &k8sapi.Affinity{}
+		if err := DecodeTemplate("affinity", cmd.Affinity, jctx, jctx.Affinity); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range cmd.TopologySpreadKeys {
+		jctx.TopologySpreadConstraints = append(jctx.TopologySpreadConstraints, k8sapi.TopologySpreadConstraint{
+			MaxSkew:           cmd.TopologySpreadMaxSkew,
+			TopologyKey:       key,
+			WhenUnsatisfiable: k8sapi.UnsatisfiableConstraintAction(cmd.TopologySpreadWhenUnsatisfiable),
+			LabelSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{
+					{Key: labelPrefix + "/id", Operator: metav1.LabelSelectorOpExists},
+				},
+			},
+		})
+	}
+	if cmd.TopologySpreadConstraints != "" {
+		jctx.TopologySpreadConstraints = nil
+		if err := DecodeTemplate("topology spread constraints", cmd.TopologySpreadConstraints, jctx, &jctx.TopologySpreadConstraints); err != nil {
+			return err
+		}
+	}
+
+	if jctx.ScratchDiskSize != "" && cmd.ScratchDiskMountPoint != "" {
+		if jctx.CloudInitUserDataSecret != "" {
+			return fmt.Errorf("--scratch-disk-mount-point cannot be used with cloud-init user-data from a Secret")
+		}
+
+		var err error
+		jctx.CloudInitUserData, err = AddDiskMount(jctx.CloudInitUserData, scratchDiskDevice, cmd.ScratchDiskMountPoint, "scratch")
+		if err != nil {
+			return err
+		}
+	}
+
+	if cmd.BuildsPVC != "" && jctx.VMITemplate == "" {
+		if jctx.CloudInitUserDataSecret != "" {
+			return fmt.Errorf("--builds-pvc cannot be used with cloud-init user-data from a Secret")
+		}
+
+		jctx.BuildsClaim = cmd.BuildsPVC
+
+		var err error
+		jctx.CloudInitUserData, err = AddVirtiofsMount(jctx.CloudInitUserData, "builds", cmd.BuildsDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cmd.CacheSize != "" && jctx.VMITemplate == "" {
+		if jctx.CloudInitUserDataSecret != "" {
+			return fmt.Errorf("--cache-size cannot be used with cloud-init user-data from a Secret")
+		}
+
+		var err error
+		jctx.CacheClaim, err = AcquireCache(timeout, client, jctx, cmd.CacheSize, cmd.Timeout)
+		if err != nil {
+			return err
+		}
+		if jctx.CacheClaim != "" {
+			jctx.CloudInitUserData, err = AddDiskMount(jctx.CloudInitUserData, cacheDevice, cmd.CacheDir, "cache")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	rc := cmd.RunConfig
+	if rc.SSH.Resumable && rc.Shell != "bash" {
+		return fmt.Errorf("--ssh-resumable is only supported with the bash shell")
+	}
+	if cmd.ReadinessProbe != "" && rc.Method != "ssh" {
+		return fmt.Errorf("--readiness-probe is only supported with the ssh method")
+	}
+	if cmd.StepRunner != "" && (rc.Method != "ssh" || rc.Shell != "bash") {
+		return fmt.Errorf("--step-runner is only supported with the ssh method and the bash shell")
+	}
 
-	vm, err := CreateJobVM(ctx, client, jctx, &rc)
+	// A retried prepare adopts the VM it created before rather than
+	// creating a duplicate.
+	vm, err := AdoptableJobVM(ctx, client, jctx)
 	if err != nil {
 		return err
 	}
 
-	fmt.Fprintf(os.Stderr, "Waiting for Virtual Machine instance %s to be ready...\n", vm.ObjectMeta.Name)
+	if vm == nil && cmd.MaxVMs > 0 {
+		queueCtx := timeout
+		if cmd.QueueTimeout != 0 {
+			var stop context.CancelFunc
+			queueCtx, stop = context.WithTimeout(timeout, cmd.QueueTimeout)
+			defer stop()
+		}
 
-	// Wait for new VM to get an IP
+		section := StartSection("prepare_queue", "Waiting for a Virtual Machine instance slot")
+		err := WaitForVMSlot(queueCtx, client, jctx.Namespace, cmd.MaxVMs)
+		section.End()
+		if err != nil {
+			return err
+		}
+	}
 
-	timeout, stop := context.WithTimeout(ctx, cmd.Timeout)
-	defer stop()
+	var sshKey []byte
+	if rc.SSH.EphemeralKey && vm != nil {
+		sshKey, err = GetSSHKey(ctx, client, vm)
+		if err != nil {
+			return fmt.Errorf("cannot adopt Virtual Machine instance %s, whose ephemeral ssh key was lost: %w", vm.ObjectMeta.Name, err)
+		}
+	} else if rc.SSH.EphemeralKey {
+		if jctx.CloudInitUserDataSecret != "" {
+			return fmt.Errorf("--ssh-ephemeral-key cannot be used with cloud-init user-data from a Secret")
+		}
 
-	err = WatchJobVM(timeout, client, jctx, vm, func(et watch.EventType, val *kubevirtapi.VirtualMachineInstance) error {
+		var pubKey string
+		var err error
+		sshKey, pubKey, err = GenerateSSHKey()
+		if err != nil {
+			return err
+		}
+		jctx.CloudInitUserData, err = AuthorizeSSHKey(jctx.CloudInitUserData, pubKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cmd.NetworkPolicy || cmd.RestrictEgress {
+		config := NetworkPolicyConfig{
+			SSHPort:         rc.SSH.Port,
+			RunnerNamespace: cmd.NetworkPolicyRunnerNamespace,
+			RunnerSelector:  cmd.NetworkPolicyRunnerSelector,
+			DNSNamespace:    cmd.NetworkPolicyDNSNamespace,
+			DNSSelector:     cmd.NetworkPolicyDNSSelector,
+			Egress:          cmd.NetworkPolicyEgress,
+			ExposedPorts:    exposedPorts,
+		}
+		if err := CreateJobNetworkPolicy(ctx, client, jctx, config); err != nil {
+			return err
+		}
+	}
+
+	if cmd.Services && jctx.Job != nil && len(jctx.Job.Services) > 0 {
+		if jctx.CloudInitUserDataSecret != "" {
+			return fmt.Errorf("--services cannot be used with cloud-init user-data from a Secret")
+		}
+
+		section := StartSection("prepare_services", "Starting services")
+		defer section.End()
+
+		hosts, err := StartServices(timeout, client, jctx)
+		if err != nil {
+			return err
+		}
+		section.End()
+
+		jctx.CloudInitUserData, err = AddHostsEntries(jctx.CloudInitUserData, hosts)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cmd.JobRegistryCredentials && jctx.ImagePullSecret == "" {
+		jctx.ImagePullSecret, err = CreateJobRegistrySecret(ctx, client, jctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	section := StartSection("prepare_vm_creation", "Creating Virtual Machine instance")
+	defer func() { section.End() }()
+
+	created := false
+	if vm != nil {
+		fmt.Fprintf(os.Stderr, "Adopting existing Virtual Machine instance %s\n", vm.ObjectMeta.Name)
+	} else {
+		start := time.Now()
+		err = RetryCreate(timeout, "Virtual Machine instance", cmd.CreateRetryTimeout, func() (err error) {
+			vm, err = CreateJobVM(timeout, client, jctx, &rc)
+			return err
+		})
+		tracer.Record("create", start, err)
+		var limitErr *ResourceLimitError
+		if errors.As(err, &limitErr) {
+			fmt.Fprintln(os.Stderr, limitErr)
+			buildFailureExit()
+		}
+		if err != nil {
+			return err
+		}
+		created = true
+
+		// The key is stored right away, since retries of the stage cannot
+		// adopt the VM without it.
+		if sshKey != nil {
+			if err := CreateSSHKeySecret(ctx, client, vm, sshKey); err != nil {
+				// Nor can they use a VM whose key is lost.
+				if derr := DeleteJobVM(context.Background(), client, vm); derr != nil && !k8serrors.IsNotFound(derr) {
+					fmt.Fprintf(os.Stderr, "%v\n", derr)
+				}
+				return err
+			}
+		}
+	}
+	defer func() {
+		if ctx.Err() != nil {
+			DeleteCancelledJobVM(client, vm)
+		}
+	}()
+
+	if jctx.VMITemplate == "" && hasRootDataVolume(jctx) {
+		fmt.Fprintf(os.Stderr, "Waiting for the root disk of Virtual Machine instance %s to be populated...\n", vm.ObjectMeta.Name)
+
+		if err := WaitForDataVolume(timeout, client, jctx.Namespace, rootDataVolumeName(jctx)); err != nil {
+			return err
+		}
+	}
+	section.End()
+
+	section = StartSection("prepare_vm_scheduling", fmt.Sprintf("Waiting for Virtual Machine instance %s to be scheduled...", vm.ObjectMeta.Name))
+	booting := false
+	unschedulable := ""
+	pullFailure := ""
+
+	phaseCtx, phases := newPhaseDeadline(timeout)
+	defer phases.Close()
+	phases.Start("getting scheduled", cmd.SchedulingTimeout)
+	tracer.SetAttributes("k8s.vmi.name", vm.ObjectMeta.Name)
+
+	phaseStart := time.Now()
+	endPhase := func(name string) {
+		metrics.Observe(metricsPrefix+"vm_"+strings.Replace(name, "-", "_", -1)+"_duration_seconds", time.Since(phaseStart))
+		tracer.Record(name, phaseStart, nil)
+		phaseStart = time.Now()
+	}
+
+	// Wait for new VM to get an IP
+
+	err = WatchJobVM(phaseCtx, client, jctx, vm, func(et watch.EventType, val *kubevirtapi.VirtualMachineInstance) error {
 		if et == watch.Error {
 			// Retry on watch failure
 			return nil
 		}
 		vm = val
-		if len(vm.Status.Interfaces) == 0 || vm.Status.Interfaces[0].IP == "" {
+		// Instances created through a VirtualMachine only exist once
+		// observed here.
+		if created && vm.ObjectMeta.UID != "" {
+			RecordJobEvent(ctx, client, vm, k8sapi.EventTypeNormal, EventCreated, "Created for job %s", jctx.JobID)
+			created = false
+		}
+		if reason, ok := VMIUnschedulable(vm); ok && cmd.FailUnschedulable {
+			unschedulable = reason
+			return ErrWatchDone
+		}
+		if reason, ok := VMIImagePullFailure(vm); ok {
+			pullFailure = reason
+			return ErrWatchDone
+		}
+		if !booting && vm.Status.NodeName != "" {
+			section.End()
+			section = StartSection("prepare_vm_boot", fmt.Sprintf("Waiting for Virtual Machine instance %s to boot on node %s...", vm.ObjectMeta.Name, vm.Status.NodeName))
+			phases.Start("booting", cmd.BootTimeout)
+			endPhase("schedule")
+			booting = true
+		}
+		if _, ok := VMIAddress(vm, rc.Connect); rc.Method == "ssh" && !rc.SSH.Tunnel && !ok {
+			return nil
+		}
+		// The ssh server accepting connections does not mean that the
+		// guest is done booting.
+		if cmd.WaitGuestAgent && !VMICondition(vm, kubevirtapi.VirtualMachineInstanceAgentConnected) {
 			return nil
 		}
 		for _, cond := range vm.Status.Conditions {
@@ -97,22 +812,240 @@ func (cmd *PrepareCmd) Run(ctx context.Context, client kubevirt.KubevirtClient,
 		}
 		return nil
 	})
-	if err != nil {
+	if err := phases.Err(vm, err); err != nil {
+		phase := "schedule"
+		if booting {
+			phase = "boot"
+		}
+		tracer.Record(phase, phaseStart, err)
+		RecordJobEvent(ctx, client, vm, k8sapi.EventTypeWarning, EventJobFailed, "Preparing job %s failed: %v", jctx.JobID, err)
 		return err
 	}
+	section.End()
+
+	if unschedulable != "" {
+		fmt.Fprintf(os.Stderr, "Virtual Machine instance %s cannot be scheduled: %s\n", vm.ObjectMeta.Name, unschedulable)
+		RecordJobEvent(ctx, client, vm, k8sapi.EventTypeWarning, EventJobFailed, "Preparing job %s failed: cannot be scheduled: %s", jctx.JobID, unschedulable)
+		systemFailureExit()
+	}
+	if pullFailure != "" {
+		fmt.Fprintf(os.Stderr, "Pulling the images of Virtual Machine instance %s failed: %s\n", vm.ObjectMeta.Name, pullFailure)
+		RecordJobEvent(ctx, client, vm, k8sapi.EventTypeWarning, EventJobFailed, "Preparing job %s failed: pulling images: %s", jctx.JobID, pullFailure)
+		buildFailureExit()
+	}
+	if booting {
+		endPhase("boot")
+	}
+
+	// Services are owned by the instance, which may not have existed
+	// until now when created through a VirtualMachine.
+	if cmd.Services && jctx.Job != nil && len(jctx.Job.Services) > 0 {
+		if err := AdoptServices(ctx, client, jctx, vm); err != nil {
+			return err
+		}
+	}
+	if rc.Method == "ssh" && rc.SSH.Service {
+		if err := CreateJobService(ctx, client, vm, rc.SSH.Port); err != nil {
+			return err
+		}
+	}
+	if len(exposedPorts) > 0 {
+		serviceType := k8sapi.ServiceType(cmd.ExposeServiceType)
+		if err := CreateExposedService(ctx, client, jctx, vm, serviceType, exposedPorts); err != nil {
+			return err
+		}
+	}
+	metrics.RecordActiveVMs(ctx, client, jctx.Namespace)
 
 	fmt.Fprintln(os.Stderr, "Virtual Machine instance is ready.")
+	RecordJobEvent(ctx, client, vm, k8sapi.EventTypeNormal, EventReady, "Ready for job %s on node %s", jctx.JobID, vm.Status.NodeName)
 	fmt.Fprintln(os.Stderr, "Name:", vm.ObjectMeta.Name)
 	fmt.Fprintln(os.Stderr, "Image:", jctx.Image)
 	fmt.Fprintln(os.Stderr, "Node:", vm.Status.NodeName)
-	fmt.Fprintln(os.Stderr, "IP:", vm.Status.Interfaces[0].IP)
+	if ip, ok := VMIAddress(vm, rc.Connect); ok {
+		fmt.Fprintln(os.Stderr, "IP:", ip)
+	}
+	if rc.Method == "ssh" && rc.SSH.Service {
+		fmt.Fprintln(os.Stderr, "Service:", JobServiceHost(vm))
+	}
+
+	if err := HotplugVolumes(timeout, client, jctx, vm, jctx.HotplugVolumes); err != nil {
+		return err
+	}
 
-	fmt.Fprintln(os.Stderr, "Waiting for virtual machine to become reachable via ssh...")
+	if sshKey != nil {
+		rc.SSH.privKeyData = sshKey
+	}
 
-	ssh, err := DialSSH(timeout, vm.Status.Interfaces[0].IP, rc.SSH, cmd.DialTimeout)
-	if err != nil {
+	if rc.Method != "ssh" {
+		return nil
+	}
+
+	section = StartSection("prepare_ssh", "Waiting for virtual machine to become reachable via ssh...")
+	phases.Start("becoming reachable via ssh", cmd.SSHTimeout)
+	phaseStart = time.Now()
+
+	ssh, err := ConnectSSH(phaseCtx, client, vm, rc, cmd.DialTimeout)
+	if err := phases.Err(vm, err); err != nil {
+		tracer.Record("ssh-ready", phaseStart, err)
 		return err
 	}
-	_ = ssh.Close()
+	defer ssh.Close()
+	phases.Stop()
+	endPhase("ssh-ready")
+
+	if cmd.ReadinessProbe != "" {
+		section.End()
+		section = StartSection("prepare_readiness_probe", fmt.Sprintf("Waiting for readiness probe %q to succeed...", cmd.ReadinessProbe))
+
+		if err := ProbeReadiness(timeout, ssh, cmd.ReadinessProbe); err != nil {
+			return err
+		}
+	}
+
+	if cmd.StepRunner != "" {
+		if err := InstallStepRunner(ssh, cmd.StepRunner); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// phaseDeadline bounds the phases of the wait for the VM to be ready, such
+// as its scheduling or its boot, with timeouts of their own.
+type phaseDeadline struct {
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired string
+	timeout time.Duration
+}
+
+// newPhaseDeadline returns a context that gets cancelled when the current
+// phase times out.
+func newPhaseDeadline(ctx context.Context) (context.Context, *phaseDeadline) {
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, &phaseDeadline{cancel: cancel}
+}
+
+// Start ends the current phase, and starts the specified one, which times
+// out after the specified duration, or never if it is zero.
+func (p *phaseDeadline) Start(phase string, timeout time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	if timeout == 0 {
+		return
+	}
+	p.timer = time.AfterFunc(timeout, func() {
+		p.mu.Lock()
+		p.expired, p.timeout = phase, timeout
+		p.mu.Unlock()
+		p.cancel()
+	})
+}
+
+// Stop ends the current phase.
+func (p *phaseDeadline) Stop() {
+	p.Start("", 0)
+}
+
+// Close ends the current phase, and cancels the context.
+func (p *phaseDeadline) Close() {
+	p.Stop()
+	p.cancel()
+}
+
+// Err returns an error explaining which phase timed out if one did, or err
+// otherwise.
+func (p *phaseDeadline) Err(vm *kubevirtapi.VirtualMachineInstance, err error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err != nil && p.expired != "" {
+		return fmt.Errorf("Virtual Machine instance %s timed out %s after %v", vm.ObjectMeta.Name, p.expired, p.timeout)
+	}
+	return err
+}
+
+// mergeMaps returns a new map with the entries of all the specified maps,
+// where entries of later maps take precedence.
+func mergeMaps(maps ...map[string]string) map[string]string {
+	merged := map[string]string{}
+	for _, m := range maps {
+		for k, v := range m {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// imageAllowed checks the image against the allowed and denied glob
+// patterns. Images are allowed if they match any allowed pattern, or if
+// there are none, unless they match a denied pattern.
+func imageAllowed(allowed, denied []string, image string) bool {
+	matchAny := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, image); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return (len(allowed) == 0 || matchAny(allowed)) && !matchAny(denied)
+}
+
+// checkPullPolicy checks that jobs may use the pull policy. Like with the
+// docker executor, jobs may only use the default pull policy unless more are
+// allowed.
+func (cmd *PrepareCmd) checkPullPolicy(policy k8sapi.PullPolicy) error {
+	allowed := cmd.AllowedPullPolicies
+	if len(allowed) == 0 && cmd.DefaultImagePullPolicy != "" {
+		allowed = []string{cmd.DefaultImagePullPolicy}
+	}
+	for _, name := range allowed {
+		if p, err := parsePullPolicy(name); err == nil && p == policy {
+			return nil
+		}
+	}
+	return fmt.Errorf("pull policy %q is not allowed; allowed pull policies are %v", policy, allowed)
+}
+
+// annotationAllowed checks the annotation key against the allowed glob
+// patterns. Unlike images, no annotations are allowed if there are no
+// patterns.
+func annotationAllowed(allowed []string, key string) bool {
+	for _, pattern := range allowed {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// namespacedNameAllowed checks whether the [<namespace>/]<name> reference is
+// in the allowed list, where names without a namespace are in the default
+// namespace.
+func namespacedNameAllowed(allowed []string, ref, defaultNamespace string) bool {
+	namespace, name := splitNamespacedName(ref, defaultNamespace)
+	for _, e := range allowed {
+		if ns, n := splitNamespacedName(e, defaultNamespace); ns == namespace && n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, val string) bool {
+	for _, e := range list {
+		if e == val {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestImageAllowed(t *testing.T) {
+	tests := []struct {
+		name            string
+		allowed, denied []string
+		image           string
+		want            bool
+	}{
+		{"no patterns", nil, nil, "quay.io/containerdisks/fedora:latest", true},
+		{"allowed", []string{"quay.io/containerdisks/*"}, nil, "quay.io/containerdisks/fedora:latest", true},
+		{"not allowed", []string{"quay.io/containerdisks/*"}, nil, "docker.io/library/alpine:latest", false},
+		{"star does not cross slashes", []string{"quay.io/*"}, nil, "quay.io/containerdisks/fedora:latest", false},
+		{"any allowed pattern", []string{"docker.io/*/*", "quay.io/*/*"}, nil, "quay.io/containerdisks/fedora:latest", true},
+		{"denied", nil, []string{"*/*/fedora:*"}, "quay.io/containerdisks/fedora:latest", false},
+		{"not denied", nil, []string{"*/*/fedora:*"}, "quay.io/containerdisks/ubuntu:22.04", true},
+		{"denied over allowed", []string{"quay.io/containerdisks/*"}, []string{"*/*/*:latest"}, "quay.io/containerdisks/fedora:latest", false},
+		{"empty image", []string{"quay.io/*/*"}, nil, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := imageAllowed(tt.allowed, tt.denied, tt.image); got != tt.want {
+				t.Errorf("imageAllowed(%q, %q, %q) = %v, want %v", tt.allowed, tt.denied, tt.image, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// countJobVMs returns the number of job VMs in the namespace, other than the
+// ones being deleted.
+func countJobVMs(ctx context.Context, client kubevirt.KubevirtClient, namespace string) (int, error) {
+	list, err := client.VirtualMachineInstance(namespace).List(ctx, &metav1.ListOptions{
+		LabelSelector: labelPrefix + "/id",
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, vm := range list.Items {
+		if vm.ObjectMeta.DeletionTimestamp == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// WaitForVMSlot waits until there are fewer than max job VMs in the namespace,
+// so that VMs get queued by the driver rather than sit Pending on a cluster
+// that cannot fit them. This is best-effort: jobs preparing at the same time
+// may all see the same free slot.
+func WaitForVMSlot(ctx context.Context, client kubevirt.KubevirtClient, namespace string, max int) error {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	last := -1
+	for {
+		count, err := countJobVMs(ctx, client, namespace)
+		if err != nil {
+			return err
+		}
+		if count < max {
+			return nil
+		}
+		if count != last {
+			fmt.Fprintf(os.Stderr, "Waiting for a Virtual Machine instance slot: %d/%d in use\n", count, max)
+			last = count
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("no Virtual Machine instance slot freed up in time: %w", ctx.Err())
+		}
+	}
+}
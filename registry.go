@@ -0,0 +1,102 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	k8sapi "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+type dockerAuth struct {
+	Auth     string `json:"auth,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+type dockerConfig struct {
+	Auths map[string]dockerAuth `json:"auths"`
+}
+
+func jobRegistrySecretName(jctx *JobContext) string {
+	return "job-" + jctx.ID + "-registry"
+}
+
+// jobDockerConfig returns the registry credentials of the job, in the
+// format of the docker config file, from DOCKER_AUTH_CONFIG and the
+// credentials of the GitLab container registry. It returns nil if the job
+// has no credentials.
+func jobDockerConfig(jctx *JobContext) ([]byte, error) {
+	config := dockerConfig{Auths: map[string]dockerAuth{}}
+	if jctx.DockerAuthConfig != "" {
+		if err := json.Unmarshal([]byte(jctx.DockerAuthConfig), &config); err != nil {
+			return nil, fmt.Errorf("parsing DOCKER_AUTH_CONFIG: %w", err)
+		}
+		if config.Auths == nil {
+			config.Auths = map[string]dockerAuth{}
+		}
+	}
+
+	// Credentials from DOCKER_AUTH_CONFIG take precedence, like with the
+	// docker executor.
+	if _, ok := config.Auths[jctx.Registry]; !ok && jctx.Registry != "" && jctx.RegistryUser != "" {
+		config.Auths[jctx.Registry] = dockerAuth{
+			Auth: base64.StdEncoding.EncodeToString([]byte(jctx.RegistryUser + ":" + jctx.RegistryPassword)),
+		}
+	}
+
+	if len(config.Auths) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(&config)
+}
+
+// CreateJobRegistrySecret stores the registry credentials of the job in a
+// Secret, and returns its name, or an empty string if the job has no
+// credentials. The Secret gets created before the VM, which needs it to pull
+// its containerdisks, and thus gets deleted explicitly during cleanup.
+func CreateJobRegistrySecret(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) (string, error) {
+	dockerConfig, err := jobDockerConfig(jctx)
+	if err != nil || dockerConfig == nil {
+		return "", err
+	}
+
+	secret := k8sapi.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: jobRegistrySecretName(jctx),
+			Labels: map[string]string{
+				labelPrefix + "/id":      jctx.ID,
+				labelPrefix + "/project": jctx.ProjectID,
+			},
+		},
+		Type: k8sapi.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			k8sapi.DockerConfigJsonKey: dockerConfig,
+		},
+	}
+
+	_, err = client.CoreV1().Secrets(jctx.Namespace).Create(ctx, &secret, metav1.CreateOptions{})
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return "", fmt.Errorf("creating registry credentials of the job: %w", err)
+	}
+	return secret.ObjectMeta.Name, nil
+}
+
+// DeleteJobRegistrySecret deletes the registry credentials of the job, if
+// any.
+func DeleteJobRegistrySecret(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) error {
+	err := client.CoreV1().Secrets(jctx.Namespace).Delete(ctx, jobRegistrySecretName(jctx), metav1.DeleteOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
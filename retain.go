@@ -0,0 +1,77 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// KeepUntilLabel marks VMs kept after their job failed, and holds the UNIX
+// time until which they are kept. It is a label rather than an annotation
+// so that kept VMs can be listed.
+const KeepUntilLabel = labelPrefix + "/keep-until"
+
+// RetainJobVM marks the VM of a failed job to be kept for debugging for the
+// specified duration, and prints instructions to connect to it.
+func RetainJobVM(ctx context.Context, client kubevirt.KubevirtClient, vm *kubevirtapi.VirtualMachineInstance, rc RunConfig, ttl time.Duration) error {
+	until := time.Now().Add(ttl)
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]string{
+				KeepUntilLabel: strconv.FormatInt(until.Unix(), 10),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.VirtualMachineInstance(vm.ObjectMeta.Namespace).Patch(ctx, vm.ObjectMeta.Name, types.MergePatchType, patch, &metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("keeping Virtual Machine instance %s: %w", vm.ObjectMeta.Name, err)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nVirtual Machine instance %s is kept for debugging until %s. To connect to it:\n\n", vm.ObjectMeta.Name, until.Format(time.RFC3339))
+	switch {
+	case rc.Method == "console":
+		fmt.Fprintf(os.Stderr, "  virtctl console -n %s %s\n\n", vm.ObjectMeta.Namespace, vm.ObjectMeta.Name)
+	case rc.SSH.EphemeralKey:
+		fmt.Fprintf(os.Stderr, "  kubectl get secret -n %s %s -o jsonpath='{.data.ssh-privatekey}' | base64 -d > id_job && chmod 600 id_job\n", vm.ObjectMeta.Namespace, sshKeySecretName(vm))
+		fmt.Fprintf(os.Stderr, "  virtctl ssh -n %s -i id_job --local-ssh-opts='-p %s' %s@vmi/%s\n\n", vm.ObjectMeta.Namespace, rc.SSH.Port, rc.SSH.User, vm.ObjectMeta.Name)
+	default:
+		fmt.Fprintf(os.Stderr, "  virtctl ssh -n %s --local-ssh-opts='-p %s' %s@vmi/%s\n\n", vm.ObjectMeta.Namespace, rc.SSH.Port, rc.SSH.User, vm.ObjectMeta.Name)
+	}
+	return nil
+}
+
+// RetainedUntil returns the time until which the VM is kept after its job
+// failed, if it is.
+func RetainedUntil(vm *kubevirtapi.VirtualMachineInstance) (time.Time, bool) {
+	return retainedUntil(&vm.ObjectMeta)
+}
+
+func retainedUntil(meta *metav1.ObjectMeta) (time.Time, bool) {
+	value, ok := meta.Labels[KeepUntilLabel]
+	if !ok {
+		return time.Time{}, false
+	}
+	unix, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(unix, 0), true
+}
@@ -6,14 +6,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -22,6 +26,8 @@ import (
 	"github.com/helloyi/go-sshclient"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/text/encoding/unicode"
+	k8sapi "k8s.io/api/core/v1"
+	kubevirtapi "kubevirt.io/api/core/v1"
 	kubevirt "kubevirt.io/client-go/kubecli"
 )
 
@@ -30,15 +36,103 @@ type SSHConfig struct {
 	User     string `name:"user" help:"ssh username"`
 	Password string `name:"password" xor:"auth" help:"ssh password"`
 	PrivKey  string `name:"private-key-file" xor:"auth" help:"ssh private key"`
+
+	EphemeralKey bool `name:"ephemeral-key" xor:"auth" help:"generate a fresh ssh keypair for each job, and authorize it via cloud-init"`
+	Tunnel       bool `name:"tunnel" xor:"connect" help:"connect through the Kubernetes API server rather than to the VM IP"`
+	Service      bool `name:"service" xor:"connect" help:"create a headless Service for each job VM, and connect to its DNS name rather than to the VM IP"`
+	Resumable    bool `name:"resumable" help:"run scripts detached from the ssh session, and reconnect to them if the VM gets live-migrated; bash only"`
+
+	Backoff BackoffConfig `embed prefix:"backoff-"`
+
+	// privKeyData holds the private key when it is not read from a file
+	privKeyData []byte
+}
+
+// BackoffConfig holds the parameters of the exponential backoff between
+// attempts at connecting to the ssh server of the VM.
+type BackoffConfig struct {
+	InitialInterval time.Duration `name:"initial-interval" default:"500ms" help:"interval between the first two attempts at connecting"`
+	MaxInterval     time.Duration `name:"max-interval" default:"5s" help:"maximum interval between attempts at connecting"`
+	MaxElapsedTime  time.Duration `name:"max-elapsed-time" help:"time after which to give up connecting; defaults to the retry timeout"`
+	Jitter          float64       `name:"jitter" default:"0.5" help:"randomization factor of the intervals between attempts"`
+}
+
+// defaultBackoffJitter is the jitter of run configs that predate it.
+const defaultBackoffJitter = 0.5
+
+// New returns an exponential backoff with the configured parameters. Unset
+// intervals, e.g. in the run config of VMs created by older versions, take
+// their default values.
+func (config BackoffConfig) New() *backoff.ExponentialBackOff {
+	back := backoff.NewExponentialBackOff()
+	back.RandomizationFactor = config.Jitter
+	back.MaxElapsedTime = config.MaxElapsedTime
+	back.MaxInterval = 5 * time.Second
+	if config.InitialInterval != 0 {
+		back.InitialInterval = config.InitialInterval
+	}
+	if config.MaxInterval != 0 {
+		back.MaxInterval = config.MaxInterval
+	}
+	back.Reset()
+	return back
+}
+
+type ConnectConfig struct {
+	Interface string `name:"interface" help:"name of the VM network or guest interface to connect to; defaults to the pod network"`
+	IPFamily  string `name:"ip-family" default:"any" enum:"any,ipv4,ipv6" help:"IP family of the address to connect to"`
 }
 
 type RunConfig struct {
-	Shell  string    `name:"shell" required enum:"bash,pwsh" help:"shell to use when executing script"`
-	Method string    `name:"method" default:"ssh" enum:"ssh" help:"method to execute script"`
-	SSH    SSHConfig `embed prefix:"ssh-" group:"SSH method options:"`
+	Shell   string        `name:"shell" required enum:"bash,pwsh,powershell,cmd" help:"shell to use when executing script"`
+	Method  string        `name:"method" default:"ssh" enum:"ssh,console" help:"method to execute script"`
+	SSH     SSHConfig     `embed prefix:"ssh-" group:"SSH method options:"`
+	Connect ConnectConfig `embed prefix:"connect-" group:"SSH method options:"`
+
+	KeepOnFailure time.Duration `name:"keep-on-failure" help:"keep the VM of failed jobs for debugging for this long, instead of deleting it"`
 }
 
-const RunConfigKey = labelPrefix + "/runconfig"
+const (
+	RunConfigKey = labelPrefix + "/runconfig"
+
+	// DriverVersionKey holds the version of the driver that created the VM,
+	// which tells what to expect of its run config.
+	DriverVersionKey = labelPrefix + "/driver-version"
+)
+
+// LoadRunConfig returns the run config that prepare stored on the job VM. VMs
+// that have none, e.g. because they were created by a version of the driver
+// predating it, use the run config from the fallback file instead, if any.
+func LoadRunConfig(vm *kubevirtapi.VirtualMachineInstance, fallback string) (RunConfig, error) {
+	var rc RunConfig
+
+	createdBy := vm.ObjectMeta.Annotations[DriverVersionKey]
+	if createdBy == "" {
+		createdBy = "unknown"
+	}
+
+	data, ok := vm.ObjectMeta.Annotations[RunConfigKey]
+	source := fmt.Sprintf("the %s annotation of Virtual Machine instance %s", RunConfigKey, vm.ObjectMeta.Name)
+	if !ok && fallback != "" {
+		contents, err := os.ReadFile(fallback)
+		if err != nil {
+			return rc, err
+		}
+		data, source = string(contents), fallback
+		fmt.Fprintf(os.Stderr, "Virtual Machine instance %s has no run config, using %s\n", vm.ObjectMeta.Name, fallback)
+	} else if !ok {
+		return rc, fmt.Errorf("Virtual Machine instance %s has no run config (%s annotation), and cannot be used by driver version %s; was it created by an older version of the driver, or not by the driver at all?", vm.ObjectMeta.Name, RunConfigKey, shortVersion())
+	}
+
+	// Run configs that predate the jitter do not have it, unlike those that
+	// set it to 0 for a deterministic backoff.
+	rc.SSH.Backoff.Jitter = defaultBackoffJitter
+
+	if err := json.Unmarshal([]byte(data), &rc); err != nil {
+		return rc, fmt.Errorf("the run config in %s is corrupt (created by driver version %s, read by driver version %s): %w", source, createdBy, shortVersion(), err)
+	}
+	return rc, nil
+}
 
 type RunCmd struct {
 	Script string `arg`
@@ -46,47 +140,118 @@ type RunCmd struct {
 
 	RetryTimeout time.Duration `default:"5m"`
 	DialTimeout  time.Duration `default:"10s"`
+
+	FallbackRunConfig string `name:"fallback-run-config" type:"existingfile" help:"JSON file holding the run config to use for VMs that have none, e.g. because an older version of the driver created them"`
+
+	LateRetryTimeout time.Duration `name:"late-retry-timeout" default:"30s" help:"Retry timeout of the stages running after the job script, such as after_script or the upload of artifacts"`
 }
 
-func (cmd *RunCmd) Run(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) error {
+// lateStages are the stages that run after the job script. They commonly
+// run because the job script failed, possibly because the VM crashed, and
+// must not hang on a VM that went away.
+var lateStages = map[string]bool{
+	"after_script":                true,
+	"archive_cache":               true,
+	"archive_cache_on_failure":    true,
+	"upload_artifacts_on_success": true,
+	"upload_artifacts_on_failure": true,
+	"cleanup_file_variables":      true,
+}
+
+// retryTimeout returns the retry budget of the stage being run.
+func (cmd *RunCmd) retryTimeout() time.Duration {
+	if lateStages[cmd.Stage] && cmd.LateRetryTimeout < cmd.RetryTimeout {
+		return cmd.LateRetryTimeout
+	}
+	return cmd.RetryTimeout
+}
+
+func (cmd *RunCmd) Run(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) (err error) {
+	metrics.StartStage(ctx, cmd.Stage)
+	tracer.StartStage(ctx, jctx, cmd.Stage)
 
 	vm, err := FindJobVM(ctx, client, jctx)
 	if err != nil {
 		return err
 	}
 
-	var rc RunConfig
-	if err := json.Unmarshal([]byte(vm.Annotations[RunConfigKey]), &rc); err != nil {
+	rc, err := LoadRunConfig(vm, cmd.FallbackRunConfig)
+	if err != nil {
 		return err
 	}
 
+	// jobFailed records that the stage failed, and keeps the VM around for
+	// debugging if asked to.
+	jobFailed := func(reason string) {
+		RecordJobEvent(ctx, client, vm, k8sapi.EventTypeWarning, EventJobFailed, "Stage %s of job %s failed: %s", cmd.Stage, jctx.JobID, reason)
+		if rc.KeepOnFailure == 0 {
+			return
+		}
+		if err := RetainJobVM(ctx, client, vm, rc, rc.KeepOnFailure); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}
+	defer func() {
+		switch {
+		case err == nil:
+		case ctx.Err() != nil:
+			MarkJobVMCancelled(client, vm)
+		default:
+			jobFailed(err.Error())
+		}
+	}()
+
 	if vm.Status.Phase != "Running" {
 		return fmt.Errorf("Virtual Machine instance %s is not running (phase: %v)", vm.ObjectMeta.Name, vm.Status.Phase)
 	}
-	if len(vm.Status.Interfaces) == 0 || vm.Status.Interfaces[0].IP == "" {
-		return fmt.Errorf("Virtual Machine instance %s has no IP; is it running?", vm.ObjectMeta.Name)
-	}
-	ip := vm.Status.Interfaces[0].IP
+	RecordJobEvent(ctx, client, vm, k8sapi.EventTypeNormal, EventJobStageStarted, "Stage %s of job %s started", cmd.Stage, jctx.JobID)
+
+	running, vmFailure, stopWatching := WatchJobVMFailure(ctx, client, jctx, vm)
+	defer stopWatching()
+	defer func() {
+		failure := vmFailure()
+		if err == nil || failure == nil {
+			return
+		}
+		fmt.Fprintln(os.Stderr, failure.Reason)
+		if !failure.Shutdown {
+			systemFailureExit()
+		}
+		jobFailed(failure.Reason)
+		buildFailureExit()
+	}()
 
-	timeout, stop := context.WithTimeout(ctx, cmd.RetryTimeout)
+	retryTimeout := cmd.retryTimeout()
+	timeout, stop := context.WithTimeout(running, retryTimeout)
 	defer stop()
 
+	ext := rc.Shell
+	switch rc.Shell {
+	case "pwsh", "powershell":
+		ext = "ps1"
+	}
+
+	scriptPath := path.Join(cmd.Stage + "." + ext)
+
 	switch rc.Method {
 	case "ssh":
-		client, err := DialSSH(timeout, ip, rc.SSH, cmd.DialTimeout)
+		if rc.SSH.EphemeralKey {
+			rc.SSH.privKeyData, err = GetSSHKey(ctx, client, vm)
+			if err != nil {
+				return err
+			}
+		}
+
+		kubeClient := client
+		client, err := ConnectSSH(timeout, client, vm, rc, cmd.DialTimeout)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("could not connect to Virtual Machine instance %s within %v", vm.ObjectMeta.Name, retryTimeout)
+		}
 		if err != nil {
 			return err
 		}
 		defer client.Close()
 
-		ext := rc.Shell
-		switch rc.Shell {
-		case "pwsh":
-			ext = "ps1"
-		}
-
-		scriptPath := path.Join(cmd.Stage + "." + ext)
-
 		fmt.Fprintf(Debug, "uploading script %v\n", cmd.Script)
 		if err := client.Sftp().Upload(cmd.Script, scriptPath); err != nil {
 			return err
@@ -103,10 +268,15 @@ func (cmd *RunCmd) Run(ctx context.Context, client kubevirt.KubevirtClient, jctx
 			fmt.Fprintf(Debug, "---\n", cmd.Script)
 		}
 
-		argv := generateShellArgv(rc.Shell, scriptPath)
+		argv := append(jobEntrypoint(jctx), generateShellArgv(rc.Shell, scriptPath, vmEnv(vm, rc.Connect))...)
 
-		fmt.Fprintf(Debug, "executing %v\n", argv)
-		if err := client.Cmd(shutil.Quote(argv)).SetStdio(os.Stdout, os.Stderr).Run(); err != nil {
+		if rc.SSH.Resumable {
+			err = RunResumable(running, kubeClient, jctx, client, rc, argv, scriptPath, retryTimeout, cmd.DialTimeout)
+		} else {
+			fmt.Fprintf(Debug, "executing %v\n", argv)
+			err = RunCommand(running, client, shutil.Quote(argv), os.Stdout, os.Stderr)
+		}
+		if err != nil {
 			var exiterr *ssh.ExitError
 			if errors.As(err, &exiterr) {
 				switch {
@@ -117,10 +287,27 @@ func (cmd *RunCmd) Run(ctx context.Context, client kubevirt.KubevirtClient, jctx
 				default:
 					fmt.Fprintf(os.Stderr, "Command exited with message %q\n", exiterr.Msg())
 				}
+				jobFailed(err.Error())
 				buildFailureExit()
 			}
+			// Guest reboots do not stop the VM, but kill the ssh server
+			// before the command gets to exit.
+			var missing *ssh.ExitMissingError
+			if errors.As(err, &missing) && vmFailure() == nil {
+				return fmt.Errorf("connection to Virtual Machine instance %s was lost before the command exited; did the guest reboot?", vm.ObjectMeta.Name)
+			}
+			return err
+		}
+	case "console":
+		status, err := RunConsole(running, client, vm, rc.Shell, cmd.Script, scriptPath, cmd.DialTimeout)
+		if err != nil {
 			return err
 		}
+		if status != 0 {
+			fmt.Fprintf(os.Stderr, "Command exited with status %v\n", status)
+			jobFailed(fmt.Sprintf("command exited with status %v", status))
+			buildFailureExit()
+		}
 	default:
 		panic("unknown run method")
 	}
@@ -128,11 +315,122 @@ func (cmd *RunCmd) Run(ctx context.Context, client kubevirt.KubevirtClient, jctx
 	return nil
 }
 
-func generateShellArgv(shell, script string) []string {
+// RunCommand runs the specified command in the VM. When ctx gets cancelled,
+// e.g. because the job got cancelled or the VM stopped, the command is sent SIGTERM, and
+// given a few seconds to exit before the session gets closed.
+func RunCommand(ctx context.Context, conn *sshclient.Client, command string, stdout, stderr io.Writer) error {
+	session, err := conn.UnderlyingClient().NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	session.Stdout = stdout
+	session.Stderr = stderr
+	if err := session.Start(command); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- session.Wait() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	fmt.Fprintln(os.Stderr, "Terminating command...")
+	if err := session.Signal(ssh.SIGTERM); err != nil {
+		fmt.Fprintln(Debug, err)
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+	}
+	return ctx.Err()
+}
+
+// ProbeReadiness runs the readiness probe command in the VM until it
+// succeeds. The output of the last failed attempt gets printed if the probe
+// never does.
+func ProbeReadiness(ctx context.Context, conn *sshclient.Client, probe string) error {
+	back := backoff.NewExponentialBackOff()
+	back.MaxInterval = 10 * time.Second
+	back.MaxElapsedTime = 0
+
+	var last []byte
+	for {
+		var output bytes.Buffer
+		err := RunCommand(ctx, conn, probe, &output, &output)
+		var exiterr *ssh.ExitError
+		switch {
+		case err == nil:
+			return nil
+		case ctx.Err() != nil:
+		case errors.As(err, &exiterr):
+			fmt.Fprintf(Debug, "readiness probe failed: %v\n%s", err, output.Bytes())
+			last = output.Bytes()
+		default:
+			return err
+		}
+
+		select {
+		case <-time.After(back.NextBackOff()):
+			continue
+		case <-ctx.Done():
+		}
+		os.Stderr.Write(last)
+		return fmt.Errorf("readiness probe %q did not succeed: %w", probe, ctx.Err())
+	}
+}
+
+// jobEntrypoint returns the entrypoint of the job image, which, like with
+// the docker executor, wraps the shell running job scripts.
+func jobEntrypoint(jctx *JobContext) []string {
+	if jctx.Job == nil {
+		return nil
+	}
+	return append([]string(nil), jctx.Job.Image.Entrypoint...)
+}
+
+// vmEnv returns the environment variables describing the job VM, which are
+// exported to job scripts.
+func vmEnv(vm *kubevirtapi.VirtualMachineInstance, connect ConnectConfig) map[string]string {
+	env := map[string]string{
+		"KUBEVIRT_VM_NAME":      vm.ObjectMeta.Name,
+		"KUBEVIRT_VM_NAMESPACE": vm.ObjectMeta.Namespace,
+		"KUBEVIRT_VM_NODE":      vm.Status.NodeName,
+	}
+	if ip, ok := VMIAddress(vm, connect); ok {
+		env["KUBEVIRT_VM_IP"] = ip
+	}
+	return env
+}
+
+// generateShellArgv returns the command line running the script with the
+// specified shell and environment variables. Environment variables are not
+// supported with cmd.
+func generateShellArgv(shell, script string, env map[string]string) []string {
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
 	switch shell {
 	case "bash":
-		return []string{"bash", script}
-	case "pwsh":
+		argv := []string{"env"}
+		for _, k := range keys {
+			argv = append(argv, k+"="+env[k])
+		}
+		return append(argv, "bash", script)
+	case "cmd":
+		// /D disables AutoRun commands from the registry, and /Q disables
+		// command echoing, which matches how gitlab-runner invokes batch
+		// scripts.
+		return []string{"cmd", "/D", "/Q", "/C", script}
+	case "pwsh", "powershell":
 		// See https://gitlab.com/gitlab-org/gitlab-runner/-/blob/d5e1f7b0adb2b54d136155e3bc3ef3e5ff74d217/shells/powershell.go#L89-126
 		// for an explanation of why the base64+utf16 encoding is necessary.
 
@@ -140,12 +438,22 @@ func generateShellArgv(shell, script string) []string {
 
 		var sb strings.Builder
 		sb.WriteString("$OutputEncoding = [console]::InputEncoding = [console]::OutputEncoding = New-Object System.Text.UTF8Encoding\r\n")
-		sb.WriteString(shell + " " + script + "\r\n")
+		for _, k := range keys {
+			sb.WriteString("$env:" + k + " = '" + strings.ReplaceAll(env[k], "'", "''") + "'\r\n")
+		}
+		invocation := shell + " " + script
+		if shell == "powershell" {
+			// Unlike pwsh, Windows PowerShell interprets positional arguments
+			// as commands rather than script files, and does not look up
+			// commands in the current directory.
+			invocation = shell + " -File " + script
+		}
+		sb.WriteString(invocation + "\r\n")
 		sb.WriteString("exit $LASTEXITCODE\r\n")
 		encoded, _ := encoder.String(sb.String())
 
 		return []string{
-			"pwsh",
+			shell,
 			"-NoProfile",
 			"-NoLogo",
 			"-InputFormat",
@@ -163,13 +471,91 @@ func generateShellArgv(shell, script string) []string {
 	}
 }
 
-func DialSSH(ctx context.Context, ip string, config SSHConfig, dialTimeout time.Duration) (client *sshclient.Client, err error) {
+// ConnectSSH connects to the ssh server of the VM, either directly via its
+// IP or the DNS name of its headless Service, or through the Kubernetes API
+// server if tunneling is enabled.
+func ConnectSSH(
+	ctx context.Context,
+	client kubevirt.KubevirtClient,
+	vm *kubevirtapi.VirtualMachineInstance,
+	rc RunConfig,
+	dialTimeout time.Duration,
+) (*sshclient.Client, error) {
+
+	config := rc.SSH
+
+	if config.Service {
+		return DialSSH(ctx, net.JoinHostPort(JobServiceHost(vm), config.Port), config, dialTimeout)
+	}
 
-	back := backoff.NewExponentialBackOff()
-	back.MaxInterval = 5 * time.Second
+	if !config.Tunnel {
+		ip, ok := VMIAddress(vm, rc.Connect)
+		if !ok {
+			return nil, fmt.Errorf("Virtual Machine instance %s has no suitable IP; is it running?", vm.ObjectMeta.Name)
+		}
+		return DialSSH(ctx, net.JoinHostPort(ip, config.Port), config, dialTimeout)
+	}
+
+	port, err := strconv.Atoi(config.Port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ssh port %q: %w", config.Port, err)
+	}
+
+	ln, err := TunnelVMPort(client, vm, port)
+	if err != nil {
+		return nil, err
+	}
+	// Established connections outlive the listener, which is only needed
+	// while dialing.
+	defer ln.Close()
+
+	return DialSSH(ctx, ln.Addr().String(), config, dialTimeout)
+}
+
+// VMIAddress returns the IP to connect to on the VM. Interfaces are matched
+// by network name or by guest interface name, and default to the one on the
+// pod network; the IPs reported by the guest agent are considered along with
+// the primary IP of the interface.
+func VMIAddress(vm *kubevirtapi.VirtualMachineInstance, config ConnectConfig) (string, bool) {
+	name := config.Interface
+	if name == "" {
+		for _, network := range vm.Spec.Networks {
+			if network.Pod != nil {
+				name = network.Name
+				break
+			}
+		}
+	}
+
+	for _, iface := range vm.Status.Interfaces {
+		if name != "" && iface.Name != name && iface.InterfaceName != name {
+			continue
+		}
+		ips := iface.IPs
+		if len(ips) == 0 && iface.IP != "" {
+			ips = []string{iface.IP}
+		}
+		for _, ip := range ips {
+			addr := net.ParseIP(ip)
+			switch {
+			case addr == nil, addr.IsLinkLocalUnicast():
+				continue
+			case config.IPFamily == "ipv4" && addr.To4() == nil,
+				config.IPFamily == "ipv6" && addr.To4() != nil:
+				continue
+			}
+			return ip, true
+		}
+	}
+	return "", false
+}
+
+func DialSSH(ctx context.Context, addr string, config SSHConfig, dialTimeout time.Duration) (client *sshclient.Client, err error) {
+
+	back := config.Backoff.New()
 
 	for {
-		fmt.Fprintf(Debug, "attempting to connect to %s:%s...\n", ip, config.Port)
+		fmt.Fprintf(Debug, "attempting to connect to %s...\n", addr)
 		select {
 		case <-ctx.Done():
 			return nil, ctx.Err()
@@ -182,12 +568,15 @@ func DialSSH(ctx context.Context, ip string, config SSHConfig, dialTimeout time.
 			HostKeyCallback: ssh.HostKeyCallback(func(hostname string, remote net.Addr, key ssh.PublicKey) error { return nil }),
 		}
 
+		key := config.privKeyData
 		if config.PrivKey != "" {
-			key, err := os.ReadFile(config.PrivKey)
+			key, err = os.ReadFile(config.PrivKey)
 			if err != nil {
 				return nil, err
 			}
+		}
 
+		if key != nil {
 			signer, err := ssh.ParsePrivateKey(key)
 			if err != nil {
 				return nil, err
@@ -198,12 +587,20 @@ func DialSSH(ctx context.Context, ip string, config SSHConfig, dialTimeout time.
 
 		sshconfig.Auth = append(sshconfig.Auth, ssh.Password(config.Password))
 
-		client, err = sshclient.Dial("tcp", ip+":"+config.Port, &sshconfig)
+		client, err = sshclient.Dial("tcp", addr, &sshconfig)
 		var netErr *net.OpError
 		switch {
-		case errors.As(err, &netErr) && netErr.Op == "dial":
+		case errors.As(err, &netErr) && netErr.Op == "dial",
+			// The connection may get closed during the handshake when the ssh
+			// server isn't quite ready yet, or when tunneling to a port that
+			// isn't listening yet.
+			err != nil && strings.HasSuffix(err.Error(), "handshake failed: EOF"):
 			fmt.Fprintln(Debug, err)
-			time.Sleep(back.NextBackOff())
+			next := back.NextBackOff()
+			if next == backoff.Stop {
+				return nil, fmt.Errorf("giving up connecting to %s after %v: %w", addr, back.GetElapsedTime().Round(time.Second), err)
+			}
+			time.Sleep(next)
 			continue
 		case err != nil:
 			return nil, err
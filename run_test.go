@@ -0,0 +1,110 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtapi "kubevirt.io/api/core/v1"
+)
+
+func TestVMIAddress(t *testing.T) {
+	vm := &kubevirtapi.VirtualMachineInstance{
+		Spec: kubevirtapi.VirtualMachineInstanceSpec{
+			Networks: []kubevirtapi.Network{
+				{Name: "storage", NetworkSource: kubevirtapi.NetworkSource{Multus: &kubevirtapi.MultusNetwork{NetworkName: "storage"}}},
+				{Name: "default", NetworkSource: kubevirtapi.NetworkSource{Pod: &kubevirtapi.PodNetwork{}}},
+			},
+		},
+		Status: kubevirtapi.VirtualMachineInstanceStatus{
+			Interfaces: []kubevirtapi.VirtualMachineInstanceNetworkInterface{
+				{Name: "storage", InterfaceName: "eth1", IP: "192.168.10.4", IPs: []string{"192.168.10.4", "fd00:10::4"}},
+				{Name: "default", InterfaceName: "eth0", IP: "10.244.1.12", IPs: []string{"fe80::1", "10.244.1.12", "fd00:244::12"}},
+				{InterfaceName: "eth2", IPs: []string{"fe80::2", "172.16.0.3"}},
+				{Name: "legacy", IP: "172.17.0.5"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		config ConnectConfig
+		want   string
+		wantOK bool
+	}{
+		{"pod network", ConnectConfig{IPFamily: "any"}, "10.244.1.12", true},
+		{"pod network ipv6", ConnectConfig{IPFamily: "ipv6"}, "fd00:244::12", true},
+		{"pod network ipv4", ConnectConfig{IPFamily: "ipv4"}, "10.244.1.12", true},
+		{"by network name", ConnectConfig{Interface: "storage", IPFamily: "any"}, "192.168.10.4", true},
+		{"by network name ipv6", ConnectConfig{Interface: "storage", IPFamily: "ipv6"}, "fd00:10::4", true},
+		{"by guest interface name", ConnectConfig{Interface: "eth1", IPFamily: "any"}, "192.168.10.4", true},
+		{"skips link-local", ConnectConfig{Interface: "eth2", IPFamily: "any"}, "172.16.0.3", true},
+		{"no ipv6", ConnectConfig{Interface: "eth2", IPFamily: "ipv6"}, "", false},
+		{"primary IP only", ConnectConfig{Interface: "legacy", IPFamily: "any"}, "172.17.0.5", true},
+		{"unknown interface", ConnectConfig{Interface: "eth9", IPFamily: "any"}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := VMIAddress(vm, tt.config)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("VMIAddress(%+v) = %q, %v, want %q, %v", tt.config, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+
+	t.Run("no pod network", func(t *testing.T) {
+		vm := vm.DeepCopy()
+		vm.Spec.Networks = vm.Spec.Networks[:1]
+		// Without a network to default to, any interface will do.
+		if got, ok := VMIAddress(vm, ConnectConfig{IPFamily: "any"}); got != "192.168.10.4" || !ok {
+			t.Errorf("VMIAddress() = %q, %v, want %q, true", got, ok, "192.168.10.4")
+		}
+	})
+}
+
+func TestLoadRunConfigJitter(t *testing.T) {
+	tests := []struct {
+		name      string
+		runConfig string
+		want      float64
+	}{
+		{"no backoff", `{"Shell":"bash","Method":"ssh","SSH":{"Port":"22"}}`, defaultBackoffJitter},
+		{"no jitter", `{"Shell":"bash","Method":"ssh","SSH":{"Port":"22","Backoff":{"InitialInterval":500000000}}}`, defaultBackoffJitter},
+		{"deterministic backoff", `{"Shell":"bash","Method":"ssh","SSH":{"Port":"22","Backoff":{"Jitter":0}}}`, 0},
+		{"jitter", `{"Shell":"bash","Method":"ssh","SSH":{"Port":"22","Backoff":{"Jitter":0.2}}}`, 0.2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := &kubevirtapi.VirtualMachineInstance{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "job-1234-1",
+					Annotations: map[string]string{RunConfigKey: tt.runConfig},
+				},
+			}
+			rc, err := LoadRunConfig(vm, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rc.SSH.Backoff.Jitter != tt.want {
+				t.Errorf("jitter is %v, want %v", rc.SSH.Backoff.Jitter, tt.want)
+			}
+			if got := rc.SSH.Backoff.New().RandomizationFactor; got != tt.want {
+				t.Errorf("randomization factor of the backoff is %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("deterministic intervals", func(t *testing.T) {
+		back := BackoffConfig{InitialInterval: time.Second, MaxInterval: 4 * time.Second}.New()
+		for _, want := range []time.Duration{time.Second, 1500 * time.Millisecond, 2250 * time.Millisecond} {
+			if got := back.NextBackOff(); got != want {
+				t.Errorf("NextBackOff() = %v, want %v", got, want)
+			}
+		}
+	})
+}
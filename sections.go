@@ -0,0 +1,47 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Section is a collapsible section of the job log. See
+// https://docs.gitlab.com/ee/ci/jobs/#custom-collapsible-sections
+type Section struct {
+	name  string
+	start time.Time
+	ended bool
+}
+
+// StartSection starts a collapsed section with the specified name and
+// header in the job log.
+func StartSection(name, header string) *Section {
+	s := &Section{name: name, start: time.Now()}
+	if cli.Sections {
+		fmt.Fprintf(os.Stderr, "\x1b[0Ksection_start:%d:%s[collapsed=true]\r\x1b[0K%s\n", s.start.Unix(), name, header)
+	} else {
+		fmt.Fprintln(os.Stderr, header)
+	}
+	return s
+}
+
+// End ends the section, and reports how long it took. Ending a section more
+// than once has no effect, so that End can be deferred.
+func (s *Section) End() {
+	if s.ended {
+		return
+	}
+	s.ended = true
+
+	end := time.Now()
+	fmt.Fprintf(os.Stderr, "Took %v\n", end.Sub(s.start).Round(time.Millisecond))
+	if cli.Sections {
+		fmt.Fprintf(os.Stderr, "\x1b[0Ksection_end:%d:%s\r\x1b[0K\n", end.Unix(), s.name)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	k8sapi "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+func jobServiceName(vm *kubevirtapi.VirtualMachineInstance) string {
+	return "job-" + vm.ObjectMeta.Labels[labelPrefix+"/id"]
+}
+
+// JobServiceHost returns the DNS name of the headless Service of a job VM.
+func JobServiceHost(vm *kubevirtapi.VirtualMachineInstance) string {
+	return fmt.Sprintf("%s.%s.svc", jobServiceName(vm), vm.ObjectMeta.Namespace)
+}
+
+// CreateJobService creates a headless Service selecting the virt-launcher
+// pod of a job VM, so that the VM can be addressed by a stable DNS name
+// rather than by its IP. The Service is owned by the VM, so that it gets
+// garbage-collected along with it.
+func CreateJobService(ctx context.Context, client kubevirt.KubevirtClient, vm *kubevirtapi.VirtualMachineInstance, sshPort string) error {
+	port, err := strconv.Atoi(sshPort)
+	if err != nil {
+		return fmt.Errorf("invalid ssh port %q: %w", sshPort, err)
+	}
+
+	controller := true
+	service := k8sapi.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   jobServiceName(vm),
+			Labels: vm.ObjectMeta.Labels,
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: kubevirtapi.GroupVersion.String(),
+					Kind:       kubevirtapi.VirtualMachineInstanceGroupVersionKind.Kind,
+					Name:       vm.ObjectMeta.Name,
+					UID:        vm.ObjectMeta.UID,
+					Controller: &controller,
+				},
+			},
+		},
+		Spec: k8sapi.ServiceSpec{
+			ClusterIP: k8sapi.ClusterIPNone,
+			// Labels of the VM instance are propagated to its virt-launcher
+			// pod.
+			Selector: map[string]string{
+				labelPrefix + "/id": vm.ObjectMeta.Labels[labelPrefix+"/id"],
+			},
+			// The virt-launcher pod is ready long before the ssh server of
+			// the guest is; don't wait for it to resolve the name.
+			PublishNotReadyAddresses: true,
+			Ports: []k8sapi.ServicePort{
+				{
+					Name:       "ssh",
+					Protocol:   k8sapi.ProtocolTCP,
+					Port:       int32(port),
+					TargetPort: intstr.FromInt(port),
+				},
+			},
+		},
+	}
+
+	_, err = client.CoreV1().Services(vm.ObjectMeta.Namespace).Create(ctx, &service, metav1.CreateOptions{})
+	if k8serrors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+// DeleteJobService deletes the headless Service of a job VM, if any.
+func DeleteJobService(ctx context.Context, client kubevirt.KubevirtClient, vm *kubevirtapi.VirtualMachineInstance) error {
+	err := client.CoreV1().Services(vm.ObjectMeta.Namespace).Delete(ctx, jobServiceName(vm), metav1.DeleteOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func exposedServiceName(jctx *JobContext) string {
+	return "job-" + jctx.ID + "-ports"
+}
+
+// parseServicePorts parses <port>[/<protocol>] port specifications.
+func parseServicePorts(specs []string) ([]k8sapi.ServicePort, error) {
+	var ports []k8sapi.ServicePort
+	for _, spec := range specs {
+		number, protocol := spec, "tcp"
+		if idx := strings.Index(spec, "/"); idx != -1 {
+			number, protocol = spec[:idx], strings.ToLower(spec[idx+1:])
+		}
+		port, err := strconv.ParseUint(number, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid port %q", spec)
+		}
+		switch protocol {
+		case "tcp", "udp", "sctp":
+		default:
+			return nil, fmt.Errorf("port %s: unsupported protocol %q", spec, protocol)
+		}
+		ports = append(ports, k8sapi.ServicePort{
+			Name:       fmt.Sprintf("%s-%d", protocol, port),
+			Protocol:   k8sapi.Protocol(strings.ToUpper(protocol)),
+			Port:       int32(port),
+			TargetPort: intstr.FromInt(int(port)),
+		})
+	}
+	return ports, nil
+}
+
+// CreateExposedService creates a Service exposing the specified ports of a
+// job VM for the duration of the job. Like the headless Service, it is owned
+// by the VM.
+func CreateExposedService(
+	ctx context.Context,
+	client kubevirt.KubevirtClient,
+	jctx *JobContext,
+	vm *kubevirtapi.VirtualMachineInstance,
+	serviceType k8sapi.ServiceType,
+	ports []k8sapi.ServicePort,
+) error {
+	controller := true
+	service := k8sapi.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   exposedServiceName(jctx),
+			Labels: vm.ObjectMeta.Labels,
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: kubevirtapi.GroupVersion.String(),
+					Kind:       kubevirtapi.VirtualMachineInstanceGroupVersionKind.Kind,
+					Name:       vm.ObjectMeta.Name,
+					UID:        vm.ObjectMeta.UID,
+					Controller: &controller,
+				},
+			},
+		},
+		Spec: k8sapi.ServiceSpec{
+			Type: serviceType,
+			Selector: map[string]string{
+				labelPrefix + "/id": jctx.ID,
+			},
+			Ports: ports,
+		},
+	}
+
+	services := client.CoreV1().Services(jctx.Namespace)
+	created, err := services.Create(ctx, &service, metav1.CreateOptions{})
+	if k8serrors.IsAlreadyExists(err) {
+		created, err = services.Get(ctx, service.ObjectMeta.Name, metav1.GetOptions{})
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Exposing ports of Virtual Machine instance %s through Service %s.%s.svc\n", vm.ObjectMeta.Name, created.ObjectMeta.Name, created.ObjectMeta.Namespace)
+	for _, port := range created.Spec.Ports {
+		if port.NodePort != 0 {
+			fmt.Fprintf(os.Stderr, "  %d/%s: node port %d\n", port.Port, port.Protocol, port.NodePort)
+		}
+	}
+	return nil
+}
+
+// DeleteExposedService deletes the Service exposing the ports of the job VM,
+// if any.
+func DeleteExposedService(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) error {
+	err := client.CoreV1().Services(jctx.Namespace).Delete(ctx, exposedServiceName(jctx), metav1.DeleteOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
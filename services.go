@@ -0,0 +1,194 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	k8sapi "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// Service pods are not labeled with the job ID, as that would make them
+// match the selectors meant for the virt-launcher pod of the job VM.
+const serviceOfLabel = labelPrefix + "/service-of"
+
+// serviceAliases returns the hostnames a service is reachable by. Like other
+// executors, an alias is derived from the image name, e.g. tutum/wordpress:4
+// is reachable as tutum-wordpress and tutum__wordpress.
+func serviceAliases(service JobImage) []string {
+	name := service.Name
+	if idx := strings.Index(name, "@"); idx != -1 {
+		name = name[:idx]
+	}
+	if idx := strings.LastIndex(name, ":"); idx > strings.LastIndex(name, "/") {
+		name = name[:idx]
+	}
+
+	aliases := []string{strings.ReplaceAll(name, "/", "-")}
+	if strings.Contains(name, "/") {
+		aliases = append(aliases, strings.ReplaceAll(name, "/", "__"))
+	}
+	return append(aliases, strings.FieldsFunc(service.Alias, func(r rune) bool {
+		return r == ' ' || r == ','
+	})...)
+}
+
+// StartServices runs the services of the job as pods, waits for them to be
+// ready, and returns the hosts entries of the job VM, which map the aliases
+// of each service to the IP of its pod.
+func StartServices(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) (map[string][]string, error) {
+	resp := jctx.Job
+
+	var env []k8sapi.EnvVar
+	for _, variable := range resp.Variables {
+		if variable.File {
+			continue
+		}
+		env = append(env, k8sapi.EnvVar{Name: variable.Key, Value: variable.Value})
+	}
+
+	pods := client.CoreV1().Pods(jctx.Namespace)
+
+	automountToken := false
+	var names []string
+	for i, service := range resp.Services {
+		pullPolicy, err := imagePullPolicy(service)
+		if err != nil {
+			return nil, err
+		}
+
+		pod := k8sapi.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: fmt.Sprintf("job-%s-svc-%d", jctx.ID, i),
+				Labels: map[string]string{
+					serviceOfLabel:           jctx.ID,
+					labelPrefix + "/project": jctx.ProjectID,
+				},
+				Annotations: map[string]string{
+					"job.runner.gitlab.com/id":     jctx.JobID,
+					"job.runner.gitlab.com/url":    jctx.JobURL,
+					labelPrefix + "/service-image": service.Name,
+					labelPrefix + "/service-alias": service.Alias,
+					labelPrefix + "/pipeline-url":  jctx.PipelineURL,
+					"project.runner.gitlab.com/id": jctx.ProjectID,
+				},
+			},
+			Spec: k8sapi.PodSpec{
+				RestartPolicy: k8sapi.RestartPolicyNever,
+				// Services run images chosen by the job, which must not get
+				// the credentials of the namespace.
+				AutomountServiceAccountToken: &automountToken,
+				Containers: []k8sapi.Container{
+					{
+						Name:            "service",
+						Image:           service.Name,
+						Command:         service.Entrypoint,
+						Args:            service.Command,
+						Env:             env,
+						ImagePullPolicy: pullPolicy,
+					},
+				},
+			},
+		}
+
+		fmt.Fprintf(os.Stderr, "Starting service %s\n", service.Name)
+		_, err = pods.Create(ctx, &pod, metav1.CreateOptions{})
+		if err != nil && !k8serrors.IsAlreadyExists(err) {
+			return nil, fmt.Errorf("starting service %s: %w", service.Name, err)
+		}
+		names = append(names, pod.ObjectMeta.Name)
+	}
+
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	hosts := map[string][]string{}
+	for i, name := range names {
+		service := resp.Services[i]
+		for {
+			pod, err := pods.Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			if pod.Status.Phase == k8sapi.PodSucceeded || pod.Status.Phase == k8sapi.PodFailed {
+				return nil, fmt.Errorf("service %s exited prematurely (phase: %v)", service.Name, pod.Status.Phase)
+			}
+			if isPodReady(pod) && pod.Status.PodIP != "" {
+				fmt.Fprintf(os.Stderr, "Service %s is ready at %s\n", service.Name, pod.Status.PodIP)
+				hosts[pod.Status.PodIP] = append(hosts[pod.Status.PodIP], serviceAliases(service)...)
+				break
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return nil, fmt.Errorf("waiting for service %s: %w", service.Name, ctx.Err())
+			}
+		}
+	}
+	return hosts, nil
+}
+
+func isPodReady(pod *k8sapi.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == k8sapi.PodReady && cond.Status == k8sapi.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// AdoptServices makes the service pods of the job owned by its VM, so that
+// they get garbage-collected along with it. Service pods are started before
+// the VM, so they cannot be created with their owner.
+func AdoptServices(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext, vm *kubevirtapi.VirtualMachineInstance) error {
+	pods := client.CoreV1().Pods(jctx.Namespace)
+	list, err := pods.List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf(serviceOfLabel+"=%s", jctx.ID),
+	})
+	if err != nil {
+		return err
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"ownerReferences": []metav1.OwnerReference{
+				{
+					APIVersion: kubevirtapi.GroupVersion.String(),
+					Kind:       kubevirtapi.VirtualMachineInstanceGroupVersionKind.Kind,
+					Name:       vm.ObjectMeta.Name,
+					UID:        vm.ObjectMeta.UID,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	for _, pod := range list.Items {
+		if _, err := pods.Patch(ctx, pod.ObjectMeta.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			return fmt.Errorf("adopting service pod %s: %w", pod.ObjectMeta.Name, err)
+		}
+	}
+	return nil
+}
+
+// StopServices deletes the service pods of the job, if any.
+func StopServices(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) error {
+	return client.CoreV1().Pods(jctx.Namespace).DeleteCollection(ctx, metav1.DeleteOptions{}, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf(serviceOfLabel+"=%s", jctx.ID),
+	})
+}
@@ -0,0 +1,111 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	k8sapi "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// GenerateSSHKey generates an ed25519 keypair, and returns the PEM-encoded
+// private key along with the public key in authorized_keys format.
+func GenerateSSHKey() (privKey []byte, pubKey string, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, "", err
+	}
+	privKey = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, "", err
+	}
+	pubKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub)))
+	return privKey, pubKey, nil
+}
+
+// AuthorizeSSHKey adds the public key to the ssh_authorized_keys of the
+// specified cloud-config user-data. If userData is empty, a new cloud-config
+// is created.
+func AuthorizeSSHKey(userData, pubKey string) (string, error) {
+	return editCloudConfig(userData, "add ssh key", func(config map[string]interface{}) {
+		keys, _ := config["ssh_authorized_keys"].([]interface{})
+		config["ssh_authorized_keys"] = append(keys, pubKey)
+	})
+}
+
+func sshKeySecretName(vm *kubevirtapi.VirtualMachineInstance) string {
+	return vm.ObjectMeta.Name + "-ssh"
+}
+
+// CreateSSHKeySecret stores the private key of a job VM in a Secret owned
+// by the VM, so that it gets garbage-collected along with it. Instances that
+// the KubeVirt controller has yet to create have no UID, in which case the
+// Secret is owned by their VirtualMachine.
+func CreateSSHKeySecret(ctx context.Context, client kubevirt.KubevirtClient, vm *kubevirtapi.VirtualMachineInstance, privKey []byte) error {
+	controller := true
+	owner := metav1.OwnerReference{
+		APIVersion: kubevirtapi.GroupVersion.String(),
+		Kind:       kubevirtapi.VirtualMachineInstanceGroupVersionKind.Kind,
+		Name:       vm.ObjectMeta.Name,
+		UID:        vm.ObjectMeta.UID,
+		Controller: &controller,
+	}
+	if vm.ObjectMeta.UID == "" {
+		for _, ref := range vm.ObjectMeta.OwnerReferences {
+			if ref.Kind == kubevirtapi.VirtualMachineGroupVersionKind.Kind && ref.Controller != nil && *ref.Controller {
+				owner = ref
+			}
+		}
+	}
+	if owner.UID == "" {
+		return fmt.Errorf("cannot store the ssh key of Virtual Machine instance %s, which has no UID", vm.ObjectMeta.Name)
+	}
+
+	secret := k8sapi.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            sshKeySecretName(vm),
+			Labels:          vm.ObjectMeta.Labels,
+			OwnerReferences: []metav1.OwnerReference{owner},
+		},
+		Type: k8sapi.SecretTypeSSHAuth,
+		Data: map[string][]byte{
+			k8sapi.SSHAuthPrivateKey: privKey,
+		},
+	}
+
+	_, err := client.CoreV1().Secrets(vm.ObjectMeta.Namespace).Create(ctx, &secret, metav1.CreateOptions{})
+	if k8serrors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+// GetSSHKey retrieves the private key of a job VM.
+func GetSSHKey(ctx context.Context, client kubevirt.KubevirtClient, vm *kubevirtapi.VirtualMachineInstance) ([]byte, error) {
+	secret, err := client.CoreV1().Secrets(vm.ObjectMeta.Namespace).Get(ctx, sshKeySecretName(vm), metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting ssh key of Virtual Machine instance %s: %w", vm.ObjectMeta.Name, err)
+	}
+	return secret.Data[k8sapi.SSHAuthPrivateKey], nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"barney.ci/shutil"
+	"github.com/helloyi/go-sshclient"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// Paths of the step-runner binary and of its log in the VM, relative to the
+// home directory of the ssh user.
+const (
+	stepRunnerPath    = ".gitlab-step-runner"
+	stepRunnerLogPath = ".gitlab-step-runner.log"
+)
+
+// InstallStepRunner uploads the step-runner binary into the VM, and starts
+// its gRPC server in the background.
+func InstallStepRunner(conn *sshclient.Client, binary string) error {
+	fmt.Fprintf(os.Stderr, "Installing step-runner from %s\n", binary)
+
+	sftp := conn.Sftp()
+	if err := sftp.Upload(binary, stepRunnerPath); err != nil {
+		return fmt.Errorf("uploading step-runner: %w", err)
+	}
+	if err := sftp.Chmod(stepRunnerPath, 0755); err != nil {
+		return fmt.Errorf("uploading step-runner: %w", err)
+	}
+
+	serve := fmt.Sprintf("nohup setsid ./%s serve > %s 2>&1 < /dev/null &", stepRunnerPath, stepRunnerLogPath)
+	fmt.Fprintf(Debug, "starting %v\n", serve)
+	if err := conn.Cmd(serve).Run(); err != nil {
+		return fmt.Errorf("starting step-runner: %w", err)
+	}
+	return nil
+}
+
+// StepsProxyCmd proxies a gRPC connection to the step-runner of the job VM
+// over its stdin and stdout.
+type StepsProxyCmd struct {
+	RetryTimeout time.Duration `default:"5m"`
+	DialTimeout  time.Duration `default:"10s"`
+}
+
+func (cmd *StepsProxyCmd) Run(ctx context.Context, client kubevirt.KubevirtClient, jctx *JobContext) error {
+	vm, err := FindJobVM(ctx, client, jctx)
+	if err != nil {
+		return err
+	}
+
+	rc, err := LoadRunConfig(vm, "")
+	if err != nil {
+		return err
+	}
+	if rc.Method != "ssh" {
+		return fmt.Errorf("step-runner requires the ssh method")
+	}
+	if rc.SSH.EphemeralKey {
+		rc.SSH.privKeyData, err = GetSSHKey(ctx, client, vm)
+		if err != nil {
+			return err
+		}
+	}
+
+	timeout, stop := context.WithTimeout(ctx, cmd.RetryTimeout)
+	defer stop()
+
+	conn, err := ConnectSSH(timeout, client, vm, rc, cmd.DialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	session, err := conn.UnderlyingClient().NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	return session.Run(shutil.Quote([]string{"./" + stepRunnerPath, "proxy"}))
+}
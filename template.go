@@ -0,0 +1,50 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"text/template"
+
+	"sigs.k8s.io/yaml"
+)
+
+var templateFuncs = template.FuncMap{
+	// env returns the value of the specified job variable
+	"env": func(name string) string {
+		return os.Getenv("CUSTOM_ENV_" + name)
+	},
+}
+
+// RenderTemplate renders text as a Go template against the job context.
+func RenderTemplate(name, text string, jctx *JobContext) (string, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("parsing %s template: %w", name, err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, jctx); err != nil {
+		return "", fmt.Errorf("rendering %s template: %w", name, err)
+	}
+	return buf.String(), nil
+}
+
+// DecodeTemplate renders text as a Go template against the job context, and
+// decodes the result, which may either be YAML or JSON, into out.
+func DecodeTemplate(name, text string, jctx *JobContext, out interface{}) error {
+	rendered, err := RenderTemplate(name, text, jctx)
+	if err != nil {
+		return err
+	}
+
+	if err := yaml.UnmarshalStrict([]byte(rendered), out); err != nil {
+		return fmt.Errorf("decoding %s: %w", name, err)
+	}
+	return nil
+}
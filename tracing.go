@@ -0,0 +1,265 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Tracer records the spans of the stage being run, and exports them over
+// OTLP when the stage ends. Every stage is a process of its own, so all the
+// spans of a job share a trace ID, and the span of the job they hang off,
+// derived from the job itself. The span of the job is exported by cleanup.
+type Tracer struct {
+	ctx   context.Context
+	jctx  *JobContext
+	stage *Span
+	spans []*Span
+	done  bool
+}
+
+// Span is an operation of a job, such as a stage or a phase of a stage.
+type Span struct {
+	ID     string
+	Parent string
+	Name   string
+	Start  time.Time
+	End    time.Time
+	Attrs  map[string]string
+	Err    error
+}
+
+var tracer Tracer
+
+// Enabled is whether traces get exported at all.
+func (t *Tracer) Enabled() bool {
+	return otlpEndpoint() != ""
+}
+
+func otlpEndpoint() string {
+	if cli.OTLPEndpoint != "" {
+		return cli.OTLPEndpoint
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+}
+
+// traceID returns the ID of the trace of the job, which is the same in all
+// of its stages.
+func traceID(jctx *JobContext) string {
+	return digest(sha256.New, "trace", jctx.ID)[:32]
+}
+
+// jobSpanID returns the ID of the span of the job, which all stages are
+// children of.
+func jobSpanID(jctx *JobContext) string {
+	return digest(sha256.New, "span", jctx.ID)[:16]
+}
+
+func newSpanID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// StartStage records that the specified stage started. A stage that gets
+// cancelled through ctx ends as such.
+func (t *Tracer) StartStage(ctx context.Context, jctx *JobContext, stage string) {
+	t.ctx, t.jctx = ctx, jctx
+	t.stage = &Span{
+		ID:     newSpanID(),
+		Parent: jobSpanID(jctx),
+		Name:   stage,
+		Start:  time.Now(),
+		Attrs:  map[string]string{"ci.stage": stage},
+	}
+	t.spans = append(t.spans, t.stage)
+}
+
+// Record records an operation of the stage that started at the specified
+// time and just ended, with err if it failed.
+func (t *Tracer) Record(name string, start time.Time, err error, attrs ...string) {
+	if t.stage == nil {
+		return
+	}
+	t.spans = append(t.spans, &Span{
+		ID:     newSpanID(),
+		Parent: t.stage.ID,
+		Name:   name,
+		Start:  start,
+		End:    time.Now(),
+		Attrs:  metricLabels(attrs),
+		Err:    err,
+	})
+}
+
+// SetAttributes sets attributes of the span of the stage.
+func (t *Tracer) SetAttributes(attrs ...string) {
+	if t.stage == nil {
+		return
+	}
+	for k, v := range metricLabels(attrs) {
+		t.stage.Attrs[k] = v
+	}
+}
+
+// RecordJob records the span of the whole job, from the specified time
+// until now.
+func (t *Tracer) RecordJob(start time.Time) {
+	if t.jctx == nil {
+		return
+	}
+	t.spans = append(t.spans, &Span{
+		ID:    jobSpanID(t.jctx),
+		Name:  "job",
+		Start: start,
+		End:   time.Now(),
+	})
+}
+
+// Finish ends the span of the stage with the specified result (success,
+// build_failure, or system_failure), and exports the spans. Failing to
+// export them does not fail the stage.
+func (t *Tracer) Finish(result string) {
+	if t.done || t.stage == nil || !t.Enabled() {
+		return
+	}
+	t.done = true
+
+	if t.ctx != nil && t.ctx.Err() != nil {
+		result = "cancelled"
+	}
+	t.stage.End = time.Now()
+	t.stage.Attrs["ci.stage.result"] = result
+	if result != "success" {
+		t.stage.Err = fmt.Errorf("stage ended with %s", strings.Replace(result, "_", " ", -1))
+	}
+
+	if err := t.export(); err != nil {
+		fmt.Fprintf(os.Stderr, "exporting traces: %v\n", err)
+	}
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func otlpAttributes(attrs map[string]string) []otlpAttribute {
+	var out []otlpAttribute
+	for k, v := range attrs {
+		attr := otlpAttribute{Key: k}
+		attr.Value.StringValue = v
+		out = append(out, attr)
+	}
+	return out
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano int64           `json:"startTimeUnixNano,string"`
+	EndTimeUnixNano   int64           `json:"endTimeUnixNano,string"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+// export sends the spans to the OTLP/HTTP endpoint, encoded as JSON.
+func (t *Tracer) export() error {
+	type scopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	type resourceSpans struct {
+		Resource struct {
+			Attributes []otlpAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	var payload struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}
+
+	var scope scopeSpans
+	scope.Scope.Name = "gitlab-runner-kubevirt"
+
+	common := map[string]string{
+		"ci.job.id":          t.jctx.JobID,
+		"ci.project.id":      t.jctx.ProjectID,
+		"k8s.namespace.name": t.jctx.Namespace,
+	}
+	for _, span := range t.spans {
+		s := otlpSpan{
+			TraceID:           traceID(t.jctx),
+			SpanID:            span.ID,
+			ParentSpanID:      span.Parent,
+			Name:              span.Name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: span.Start.UnixNano(),
+			EndTimeUnixNano:   span.End.UnixNano(),
+			Attributes:        otlpAttributes(mergeMaps(common, span.Attrs)),
+		}
+		if span.Err != nil {
+			s.Status.Code = 2 // STATUS_CODE_ERROR
+			s.Status.Message = span.Err.Error()
+		}
+		scope.Spans = append(scope.Spans, s)
+	}
+
+	var resource resourceSpans
+	resource.Resource.Attributes = otlpAttributes(map[string]string{
+		"service.name":    "gitlab-runner-kubevirt",
+		"service.version": shortVersion(),
+		"ci.runner.id":    cli.RunnerID,
+	})
+	resource.ScopeSpans = []scopeSpans{scope}
+	payload.ResourceSpans = []resourceSpans{resource}
+
+	data, err := json.Marshal(&payload)
+	if err != nil {
+		return err
+	}
+
+	endpoint := strings.TrimSuffix(otlpEndpoint(), "/") + "/v1/traces"
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range cli.OTLPHeaders {
+		req.Header.Set(k, v)
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("exporting traces to %s: %s", endpoint, resp.Status)
+	}
+	return nil
+}
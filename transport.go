@@ -0,0 +1,81 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// retryTransport retries requests to the API server that failed because the
+// API server was overloaded or unavailable, which large fleets of runners
+// routinely run into.
+//
+// Requests rejected with 429 Too Many Requests were not processed, and are
+// always retried. Other failures are only retried for requests that can be
+// safely replayed, i.e. anything but creations.
+type retryTransport struct {
+	next    http.RoundTripper
+	retries int
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	back := backoff.NewExponentialBackOff()
+	back.MaxInterval = 5 * time.Second
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		resp, err := t.next.RoundTrip(req)
+		if attempt >= t.retries || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+
+		var reason string
+		wait := back.NextBackOff()
+		switch {
+		case err != nil:
+			if req.Method == http.MethodPost {
+				return resp, err
+			}
+			reason = err.Error()
+		case resp.StatusCode == http.StatusTooManyRequests:
+			reason = resp.Status
+		case resp.StatusCode == http.StatusBadGateway,
+			resp.StatusCode == http.StatusServiceUnavailable,
+			resp.StatusCode == http.StatusGatewayTimeout:
+			if req.Method == http.MethodPost {
+				return resp, err
+			}
+			reason = resp.Status
+		default:
+			return resp, err
+		}
+		if resp != nil {
+			if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+				wait = time.Duration(seconds) * time.Second
+			}
+			resp.Body.Close()
+		}
+
+		fmt.Fprintf(Debug, "%s %s: %s, retrying in %v\n", req.Method, req.URL.Path, reason, wait)
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// TunnelVMPort listens on an ephemeral local port, and forwards incoming
+// connections to the specified port of the VM through the Kubernetes API
+// server, like `virtctl port-forward` does.
+func TunnelVMPort(client kubevirt.KubevirtClient, vm *kubevirtapi.VirtualMachineInstance, port int) (net.Listener, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+
+				stream, err := client.VirtualMachineInstance(vm.ObjectMeta.Namespace).PortForward(vm.ObjectMeta.Name, port, "tcp")
+				if err != nil {
+					fmt.Fprintf(Debug, "port-forward to %s:%d: %v\n", vm.ObjectMeta.Name, port, err)
+					return
+				}
+				err = stream.Stream(kubevirt.StreamOptions{In: conn, Out: conn})
+				if err != nil {
+					fmt.Fprintf(Debug, "port-forward to %s:%d: %v\n", vm.ObjectMeta.Name, port, err)
+				}
+			}()
+		}
+	}()
+
+	return ln, nil
+}
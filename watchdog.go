@@ -0,0 +1,85 @@
+// Copyright 2023, Franklin "Snaipe" Mathieu <me@snai.pe>
+//
+// Use of this source-code is govered by the MIT license, which
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/watch"
+	kubevirtapi "kubevirt.io/api/core/v1"
+	kubevirt "kubevirt.io/client-go/kubecli"
+)
+
+// VMFailure describes why the job VM stopped running while a script was
+// running in it.
+type VMFailure struct {
+	Reason string
+
+	// Shutdown is set when the guest shut down by itself, e.g. because the
+	// job script powered it off, rather than crashing or getting deleted.
+	Shutdown bool
+}
+
+// WatchJobVMFailure watches the job VM in the background, and cancels the
+// returned context as soon as the VM stops running, so that scripts fail
+// right away rather than when ssh times out. The returned function reports
+// why the VM stopped, if it did; stop ends the watch.
+func WatchJobVMFailure(
+	ctx context.Context,
+	client kubevirt.KubevirtClient,
+	jctx *JobContext,
+	vm *kubevirtapi.VirtualMachineInstance,
+) (running context.Context, failure func() *VMFailure, stop func()) {
+	running, cancel := context.WithCancel(ctx)
+
+	var (
+		mu     sync.Mutex
+		failed *VMFailure
+	)
+	fail := func(f VMFailure) error {
+		mu.Lock()
+		failed = &f
+		mu.Unlock()
+		cancel()
+		return ErrWatchDone
+	}
+
+	watching, stopWatching := context.WithCancel(running)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = WatchJobVM(watching, client, jctx, vm, func(et watch.EventType, val *kubevirtapi.VirtualMachineInstance) error {
+			switch {
+			case et == watch.Error:
+				// Retry on watch failure
+				return nil
+			case et == watch.Deleted:
+				return fail(VMFailure{Reason: fmt.Sprintf("Virtual Machine instance %s got deleted", vm.ObjectMeta.Name)})
+			case val.ObjectMeta.UID != vm.ObjectMeta.UID:
+				return fail(VMFailure{Reason: fmt.Sprintf("Virtual Machine instance %s got restarted", vm.ObjectMeta.Name)})
+			case val.Status.Phase == kubevirtapi.Failed:
+				return fail(VMFailure{Reason: fmt.Sprintf("Virtual Machine instance %s crashed (reason: %v)", vm.ObjectMeta.Name, val.Status.Reason)})
+			case val.Status.Phase == kubevirtapi.Succeeded:
+				return fail(VMFailure{Reason: fmt.Sprintf("The guest of Virtual Machine instance %s shut down", vm.ObjectMeta.Name), Shutdown: true})
+			}
+			return nil
+		})
+	}()
+
+	failure = func() *VMFailure {
+		mu.Lock()
+		defer mu.Unlock()
+		return failed
+	}
+	stop = func() {
+		stopWatching()
+		<-done
+		cancel()
+	}
+	return running, failure, stop
+}